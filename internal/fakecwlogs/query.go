@@ -0,0 +1,167 @@
+package fakecwlogs
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const fakeAccountID = "123456789012"
+
+// pipeline is a parsed query which supports a small subset of the CloudWatch Logs Insights query syntax:
+//
+//	filter <field> like|not like|=~ /regex/
+//	filter <field> like|not like|=|!= "string"
+//	fields <field>, ...
+//	sort <field> asc|desc (ignored; results are always sorted by @timestamp desc)
+type pipeline struct {
+	filters []filter
+	fields  []string
+}
+
+type filter struct {
+	field  string
+	negate bool
+	match  func(string) bool
+}
+
+func (pl *pipeline) match(e Event) bool {
+	for _, f := range pl.filters {
+		if f.match(fieldValue(e, f.field, 0)) == f.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (pl *pipeline) row(e Event, i int) []resultField {
+	fields := pl.fields
+	if len(fields) == 0 {
+		fields = []string{"@timestamp", "@message"}
+	}
+	row := make([]resultField, 0, len(fields)+1)
+	for _, name := range fields {
+		row = append(row, resultField{Field: name, Value: fieldValue(e, name, i)})
+	}
+	return append(row, resultField{Field: "@ptr", Value: fieldValue(e, "@ptr", i)})
+}
+
+func fieldValue(e Event, name string, i int) string {
+	switch name {
+	case "@message":
+		return e.Message
+	case "@timestamp":
+		return e.Timestamp.UTC().Format("2006-01-02 15:04:05.000")
+	case "@logStream":
+		return e.LogStreamName
+	case "@log":
+		return fakeAccountID + ":" + e.LogGroupName
+	case "@ptr":
+		return fmt.Sprintf("fake-ptr-%d-%d", e.Timestamp.UnixNano(), i)
+	}
+	return ""
+}
+
+func parsePipeline(query string) (*pipeline, error) {
+	commands, err := splitCommands(query)
+	if err != nil {
+		return nil, err
+	}
+	pl := &pipeline{}
+	for _, cmd := range commands {
+		name, rest, _ := strings.Cut(cmd, " ")
+		rest = strings.TrimSpace(rest)
+		switch name {
+		case "filter":
+			f, err := parseFilter(rest)
+			if err != nil {
+				return nil, err
+			}
+			pl.filters = append(pl.filters, f)
+		case "fields":
+			for _, field := range strings.Split(rest, ",") {
+				if field = strings.TrimSpace(field); field != "" {
+					pl.fields = append(pl.fields, field)
+				}
+			}
+		case "sort":
+		default:
+			return nil, fmt.Errorf("unsupported command: %q", name)
+		}
+	}
+	return pl, nil
+}
+
+// splitCommands splits query by `|`, except inside regex or string literals
+func splitCommands(query string) ([]string, error) {
+	var (
+		commands []string
+		buf      strings.Builder
+		quote    rune
+	)
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '/' || c == '"' || c == '\'':
+			quote = c
+		case c == '|':
+			commands = append(commands, strings.TrimSpace(buf.String()))
+			buf.Reset()
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated literal %q", quote)
+	}
+	commands = append(commands, strings.TrimSpace(buf.String()))
+	for _, cmd := range commands {
+		if cmd == "" {
+			return nil, errors.New("empty command")
+		}
+	}
+	return commands, nil
+}
+
+var filterRe = regexp.MustCompile(`^(@?[\w.]+)\s+(like|not like|=~|=|!=)\s+(.+)$`)
+
+func parseFilter(expr string) (filter, error) {
+	m := filterRe.FindStringSubmatch(expr)
+	if m == nil {
+		return filter{}, fmt.Errorf("unsupported filter expression: %q", expr)
+	}
+	f := filter{field: m[1], negate: m[2] == "not like" || m[2] == "!="}
+	operand := m[3]
+	switch {
+	case len(operand) >= 2 && operand[0] == '/' && operand[len(operand)-1] == '/':
+		if m[2] == "=" || m[2] == "!=" {
+			return filter{}, fmt.Errorf("regex is not allowed with %s", m[2])
+		}
+		re, err := regexp.Compile(operand[1 : len(operand)-1])
+		if err != nil {
+			return filter{}, err
+		}
+		f.match = re.MatchString
+	case len(operand) >= 2 && (operand[0] == '"' || operand[0] == '\'') && operand[len(operand)-1] == operand[0]:
+		if m[2] == "=~" {
+			return filter{}, errors.New("=~ requires a regex")
+		}
+		s, err := strconv.Unquote(`"` + operand[1:len(operand)-1] + `"`)
+		if err != nil {
+			return filter{}, err
+		}
+		if m[2] == "=" || m[2] == "!=" {
+			f.match = func(v string) bool { return v == s }
+		} else {
+			f.match = func(v string) bool { return strings.Contains(v, s) }
+		}
+	default:
+		return filter{}, fmt.Errorf("unsupported operand: %q", operand)
+	}
+	return f, nil
+}
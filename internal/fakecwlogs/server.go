@@ -0,0 +1,313 @@
+// Package fakecwlogs provides a fake CloudWatch Logs server which speaks the
+// awsJson1.1 protocol for the CloudWatch Logs Insights query APIs.
+//
+// It is intended to run the plugin against real SDK clients in tests.
+package fakecwlogs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+const targetPrefix = "Logs_20140328."
+
+// Event is a log event seeded into the fake server
+type Event struct {
+	LogGroupName  string
+	LogStreamName string
+	Timestamp     time.Time
+	Message       string
+}
+
+// Query is a query started on the fake server
+type Query struct {
+	ID            string
+	QueryString   string
+	LogGroupNames []string
+	StartTime     time.Time
+	EndTime       time.Time
+	Limit         int
+	Status        types.QueryStatus
+	Polls         int
+	Stopped       bool
+
+	lifecycle []types.QueryStatus
+	pipeline  *pipeline
+}
+
+// Server is a fake CloudWatch Logs server
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	events    []Event
+	queries   []*Query
+	lifecycle []types.QueryStatus
+	errors    map[string][]apiError
+}
+
+type apiError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+// NewServer starts a fake server listening on plain HTTP
+func NewServer() *Server {
+	s := newServer()
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// NewTLSServer starts a fake server listening on HTTPS
+func NewTLSServer() *Server {
+	s := newServer()
+	s.Server = httptest.NewTLSServer(s)
+	return s
+}
+
+func newServer() *Server {
+	return &Server{
+		lifecycle: []types.QueryStatus{types.QueryStatusComplete},
+		errors:    make(map[string][]apiError),
+	}
+}
+
+// AddEvents seeds log events
+func (s *Server) AddEvents(events ...Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+}
+
+// SetLifecycle sets statuses which GetQueryResults returns for queries started afterwards.
+// Each GetQueryResults call advances the query to the next status, and the last status is kept.
+func (s *Server) SetLifecycle(statuses ...types.QueryStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifecycle = statuses
+}
+
+// InjectError makes the next n calls of the operation (e.g. "GetQueryResults") fail with the error type
+func (s *Server) InjectError(operation string, n int, statusCode int, errorType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.errors[operation] = append(s.errors[operation], apiError{
+			StatusCode: statusCode,
+			Type:       errorType,
+			Message:    "injected error",
+		})
+	}
+}
+
+// Queries returns copies of the queries started so far
+func (s *Server) Queries() []Query {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qs := make([]Query, 0, len(s.queries))
+	for _, q := range s.queries {
+		qs = append(qs, *q)
+	}
+	return qs
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	if !strings.HasPrefix(target, targetPrefix) {
+		writeError(w, apiError{http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("unknown target: %s", target)})
+		return
+	}
+	operation := strings.TrimPrefix(target, targetPrefix)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errs := s.errors[operation]; len(errs) > 0 {
+		s.errors[operation] = errs[1:]
+		writeError(w, errs[0])
+		return
+	}
+
+	var (
+		resp interface{}
+		err  *apiError
+	)
+	switch operation {
+	case "StartQuery":
+		resp, err = s.startQuery(r)
+	case "GetQueryResults":
+		resp, err = s.getQueryResults(r)
+	case "StopQuery":
+		resp, err = s.stopQuery(r)
+	default:
+		err = &apiError{http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("unsupported operation: %s", operation)}
+	}
+	if err != nil {
+		writeError(w, *err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(resp) // nolint
+}
+
+func writeError(w http.ResponseWriter, e apiError) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-Errortype", e.Type)
+	w.WriteHeader(e.StatusCode)
+	json.NewEncoder(w).Encode(map[string]string{ // nolint
+		"__type":  e.Type,
+		"message": e.Message,
+	})
+}
+
+func decode(r *http.Request, v interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &apiError{http.StatusBadRequest, "SerializationException", err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) findQuery(id string) (*Query, *apiError) {
+	for _, q := range s.queries {
+		if q.ID == id {
+			return q, nil
+		}
+	}
+	return nil, &apiError{http.StatusBadRequest, "ResourceNotFoundException", fmt.Sprintf("query %s not found", id)}
+}
+
+func (s *Server) startQuery(r *http.Request) (interface{}, *apiError) {
+	var input struct {
+		QueryString   string   `json:"queryString"`
+		LogGroupNames []string `json:"logGroupNames"`
+		StartTime     int64    `json:"startTime"`
+		EndTime       int64    `json:"endTime"`
+		Limit         int      `json:"limit"`
+	}
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	pl, err := parsePipeline(input.QueryString)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, "MalformedQueryException", err.Error()}
+	}
+	if input.Limit == 0 {
+		input.Limit = 1000
+	}
+	q := &Query{
+		ID:            fmt.Sprintf("fake-query-%d", len(s.queries)+1),
+		QueryString:   input.QueryString,
+		LogGroupNames: input.LogGroupNames,
+		StartTime:     time.Unix(input.StartTime, 0),
+		EndTime:       time.Unix(input.EndTime, 0),
+		Limit:         input.Limit,
+		Status:        types.QueryStatusScheduled,
+		lifecycle:     s.lifecycle,
+		pipeline:      pl,
+	}
+	s.queries = append(s.queries, q)
+	return map[string]string{"queryId": q.ID}, nil
+}
+
+type resultField struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+func (s *Server) getQueryResults(r *http.Request) (interface{}, *apiError) {
+	var input struct {
+		QueryID string `json:"queryId"`
+	}
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	q, err := s.findQuery(input.QueryID)
+	if err != nil {
+		return nil, err
+	}
+	if !q.Stopped {
+		if q.Polls < len(q.lifecycle) {
+			q.Status = q.lifecycle[q.Polls]
+		}
+		q.Polls++
+	}
+
+	var (
+		scanned, matched []Event
+		bytesScanned     int
+	)
+	for _, e := range s.events {
+		if !q.covers(e) {
+			continue
+		}
+		scanned = append(scanned, e)
+		bytesScanned += len(e.Message)
+		if q.pipeline.match(e) {
+			matched = append(matched, e)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Timestamp.After(matched[j].Timestamp)
+	})
+	results := [][]resultField{}
+	if q.Status == types.QueryStatusComplete || q.Status == types.QueryStatusRunning {
+		for i, e := range matched {
+			if i >= q.Limit {
+				break
+			}
+			results = append(results, q.pipeline.row(e, i))
+		}
+	}
+	return map[string]interface{}{
+		"status":  q.Status,
+		"results": results,
+		"statistics": map[string]interface{}{
+			"recordsMatched": len(matched),
+			"recordsScanned": len(scanned),
+			"bytesScanned":   bytesScanned,
+		},
+	}, nil
+}
+
+func (s *Server) stopQuery(r *http.Request) (interface{}, *apiError) {
+	var input struct {
+		QueryID string `json:"queryId"`
+	}
+	if err := decode(r, &input); err != nil {
+		return nil, err
+	}
+	q, err := s.findQuery(input.QueryID)
+	if err != nil {
+		return nil, err
+	}
+	switch q.Status {
+	case types.QueryStatusScheduled, types.QueryStatusRunning:
+	default:
+		return nil, &apiError{http.StatusBadRequest, "InvalidParameterException", fmt.Sprintf("query %s is not running", q.ID)}
+	}
+	q.Status = types.QueryStatusCancelled
+	q.Stopped = true
+	return map[string]bool{"success": true}, nil
+}
+
+// covers reports whether the event is in the log groups and the time range of the query
+func (q *Query) covers(e Event) bool {
+	if e.Timestamp.Before(q.StartTime) || e.Timestamp.After(q.EndTime) {
+		return false
+	}
+	for _, name := range q.LogGroupNames {
+		if name == e.LogGroupName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package fakecwlogs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/smithy-go"
+)
+
+func newClient(s *Server) *cloudwatchlogs.Client {
+	return cloudwatchlogs.New(cloudwatchlogs.Options{
+		Region:       "ap-northeast-1",
+		BaseEndpoint: aws.String(s.URL),
+		Credentials:  aws.AnonymousCredentials{},
+		HTTPClient:   s.Client(),
+		// do not hide injected errors by retries
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestServer_query(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	s := NewServer()
+	defer s.Close()
+	s.AddEvents(
+		Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-3 * time.Minute), Message: "omg first"},
+		Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-2 * time.Minute), Message: "fine"},
+		Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-1 * time.Minute), Message: "omg second"},
+		Event{LogGroupName: "/log/bar", LogStreamName: "app", Timestamp: now.Add(-1 * time.Minute), Message: "omg other group"},
+		Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-1 * time.Hour), Message: "omg too old"},
+	)
+	s.SetLifecycle(types.QueryStatusRunning, types.QueryStatusComplete)
+
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  []types.QueryStatus
+		wantMatched int64
+		wantFields  [][]string
+	}{
+		{
+			name:        "regex filter",
+			query:       "filter @message like /omg/",
+			wantStatus:  []types.QueryStatus{types.QueryStatusRunning, types.QueryStatusComplete},
+			wantMatched: 2,
+			wantFields:  [][]string{{"@timestamp", "@message", "@ptr"}, {"@timestamp", "@message", "@ptr"}},
+		},
+		{
+			name:        "negated string filter with fields",
+			query:       `filter @message not like "omg" | fields @message, @logStream`,
+			wantStatus:  []types.QueryStatus{types.QueryStatusRunning, types.QueryStatusComplete},
+			wantMatched: 1,
+			wantFields:  [][]string{{"@message", "@logStream", "@ptr"}},
+		},
+		{
+			name:        "regex containing pipe",
+			query:       "filter @message =~ /first|second/ | sort @timestamp desc",
+			wantStatus:  []types.QueryStatus{types.QueryStatusRunning, types.QueryStatusComplete},
+			wantMatched: 2,
+			wantFields:  [][]string{{"@timestamp", "@message", "@ptr"}, {"@timestamp", "@message", "@ptr"}},
+		},
+	}
+	client := newClient(s)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			q, err := client.StartQuery(ctx, &cloudwatchlogs.StartQueryInput{
+				LogGroupNames: []string{"/log/foo"},
+				QueryString:   aws.String(tt.query),
+				StartTime:     aws.Int64(now.Add(-5 * time.Minute).Unix()),
+				EndTime:       aws.Int64(now.Unix()),
+				Limit:         aws.Int32(10),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out *cloudwatchlogs.GetQueryResultsOutput
+			var statuses []types.QueryStatus
+			for i := 0; i < len(tt.wantStatus); i++ {
+				out, err = client.GetQueryResults(ctx, &cloudwatchlogs.GetQueryResultsInput{QueryId: q.QueryId})
+				if err != nil {
+					t.Fatal(err)
+				}
+				statuses = append(statuses, out.Status)
+			}
+			if !reflect.DeepEqual(statuses, tt.wantStatus) {
+				t.Errorf("statuses = %v, want %v", statuses, tt.wantStatus)
+			}
+			if out.Statistics.RecordsMatched != float64(tt.wantMatched) {
+				t.Errorf("RecordsMatched = %v, want %v", out.Statistics.RecordsMatched, tt.wantMatched)
+			}
+			var fields [][]string
+			for _, row := range out.Results {
+				var names []string
+				for _, f := range row {
+					names = append(names, *f.Field)
+				}
+				fields = append(fields, names)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestServer_stopQuery(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetLifecycle(types.QueryStatusRunning)
+	client := newClient(s)
+	ctx := context.Background()
+
+	q, err := client.StartQuery(ctx, &cloudwatchlogs.StartQueryInput{
+		LogGroupNames: []string{"/log/foo"},
+		QueryString:   aws.String("filter @message like /omg/"),
+		StartTime:     aws.Int64(0),
+		EndTime:       aws.Int64(60),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.StopQuery(ctx, &cloudwatchlogs.StopQueryInput{QueryId: q.QueryId}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := client.GetQueryResults(ctx, &cloudwatchlogs.GetQueryResultsInput{QueryId: q.QueryId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Status != types.QueryStatusCancelled {
+		t.Errorf("Status = %v, want Cancelled", out.Status)
+	}
+	if qs := s.Queries(); len(qs) != 1 || !qs[0].Stopped {
+		t.Errorf("Queries() = %+v, want a stopped query", qs)
+	}
+}
+
+func TestServer_errors(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	client := newClient(s)
+	ctx := context.Background()
+
+	_, err := client.StartQuery(ctx, &cloudwatchlogs.StartQueryInput{
+		LogGroupNames: []string{"/log/foo"},
+		QueryString:   aws.String("stats count(*) by bin(1m)"),
+		StartTime:     aws.Int64(0),
+		EndTime:       aws.Int64(60),
+	})
+	var malformed *types.MalformedQueryException
+	if !errors.As(err, &malformed) {
+		t.Errorf("StartQuery() error = %v, want MalformedQueryException", err)
+	}
+
+	s.InjectError("StartQuery", 1, 400, "LimitExceededException")
+	_, err = client.StartQuery(ctx, &cloudwatchlogs.StartQueryInput{
+		LogGroupNames: []string{"/log/foo"},
+		QueryString:   aws.String("filter @message like /omg/"),
+		StartTime:     aws.Int64(0),
+		EndTime:       aws.Int64(60),
+	})
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "LimitExceededException" {
+		t.Errorf("StartQuery() error = %v, want LimitExceededException", err)
+	}
+}
@@ -4,17 +4,20 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
@@ -22,7 +25,6 @@ import (
 	"github.com/mackerelio/checkers"
 	"github.com/mackerelio/golib/logging"
 	"github.com/mackerelio/golib/pluginutil"
-	"github.com/natefinch/atomic"
 )
 
 var logger *logging.Logger
@@ -34,46 +36,211 @@ func init() {
 
 // copy from check-aws-cloudwatch-logs
 type logOpts struct {
-	LogGroupNames []string `long:"log-group-name" required:"true" value-name:"LOG-GROUP-NAME" description:"Log group name" unquote:"false"`
+	LogGroupNames []string `long:"log-group-name" value-name:"LOG-GROUP-NAME" description:"Log group name (Required unless --query-language=sql)" unquote:"false"`
+	QueryLanguage string   `long:"query-language" value-name:"LANGUAGE" choice:"cwli" choice:"ppl" choice:"sql" default:"cwli" description:"Query language of --filter: CloudWatch Logs Insights QL, OpenSearch PPL or OpenSearch SQL"`
 
-	Filter        string `short:"f" long:"filter" required:"true" value-name:"FILTER" description:"Filter expression to use search logs via CloudWatch Logs Insights" unquote:"false"`
+	Filter        string `short:"f" long:"filter" value-name:"FILTER" description:"Filter expression to use search logs via CloudWatch Logs Insights (Required unless --filter-file or --query-definition)" unquote:"false"`
 	WarningOver   int    `short:"w" long:"warning-over" value-name:"WARNING" description:"Trigger a warning if matched lines is over a number"`
 	CriticalOver  int    `short:"c" long:"critical-over" value-name:"CRITICAL" description:"Trigger a critical if matched lines is over a number"`
 	StateDir      string `short:"s" long:"state-dir" value-name:"DIR" description:"Dir to keep state files under" unquote:"false"`
-	ReturnMessage bool   `short:"r" long:"return" description:"Output matched log messages (Up to 10 messages)"`
+	ReturnMessage bool   `short:"r" long:"return" description:"Output matched log messages (Up to --return-limit messages)"`
 	Debug         bool   `long:"debug" description:"Enable debug log"`
+
+	ReturnFields     []string `long:"return-fields" value-name:"FIELDS" description:"Comma separated fields to output with --return in addition to @message (e.g. @timestamp,@logStream)" unquote:"false"`
+	ReturnLimit      int      `long:"return-limit" value-name:"N" default:"10" description:"Number of log messages to output with --return (Up to 10000)"`
+	MessageMaxLength int      `long:"message-max-length" value-name:"BYTES" description:"Truncate each log message output with --return to BYTES"`
+	OutputMaxBytes   int      `long:"output-max-bytes" value-name:"BYTES" description:"Drop log messages output with --return to keep the check message within BYTES"`
+
+	GroupMessages   bool `long:"group-messages" description:"Group similar returned messages with their counts"`
+	GroupServerSide bool `long:"group-server-side" description:"With --group-messages, group all messages in the window by the pattern command of CloudWatch Logs Insights"`
+
+	Redact     bool   `long:"redact" description:"Redact AWS keys, JWTs, email addresses and credit card numbers in returned messages"`
+	RedactFile string `long:"redact-file" value-name:"FILE" description:"File of regular expressions to redact in returned messages, one per line as REGEX or REGEX => REPLACEMENT" unquote:"false"`
+
+	FilterFile string   `long:"filter-file" value-name:"FILE" description:"File containing the filter expression instead of --filter. It is a Go text/template rendered with --var" unquote:"false"`
+	Vars       []string `long:"var" value-name:"KEY=VALUE" description:"Value for {{.KEY}} in --filter-file or --filter" unquote:"false"`
+	EnvVars    []string `long:"env-var" value-name:"NAME" description:"Environment variable to expose as {{.Env.NAME}} in --filter-file or --filter" unquote:"false"`
+
+	QueryDefinition    string        `long:"query-definition" value-name:"NAME-OR-ID" description:"Use the query string and log groups of the saved query instead of --filter"`
+	QueryDefinitionTTL time.Duration `long:"query-definition-ttl" value-name:"DURATION" default:"1h" description:"Cache the saved query for DURATION in the state dir. 0 disables the cache"`
+
+	MinConsecutive int `long:"min-consecutive" value-name:"N" default:"1" description:"Alert only after thresholds are exceeded in N runs in a row"`
+	RecoverAfter   int `long:"recover-after" value-name:"M" default:"1" description:"Go back to OK only after M runs in a row within thresholds"`
+
+	AnomalyStddev      float64 `long:"anomaly-stddev" value-name:"K" description:"Alert when the rate of matched lines is more than K standard deviations above the baseline of the same hour of the week"`
+	AnomalyPercent     float64 `long:"anomaly-percent" value-name:"X" description:"Alert when the rate of matched lines is more than X% above the baseline of the same hour of the week"`
+	AnomalyStatus      string  `long:"anomaly-status" value-name:"STATUS" choice:"warning" choice:"critical" default:"warning" description:"Status on an anomaly"`
+	AnomalyWeeks       int     `long:"anomaly-weeks" value-name:"N" default:"4" description:"Keep N weeks of history in the state dir for the baseline"`
+	AnomalyMinSamples  int     `long:"anomaly-min-samples" value-name:"N" default:"3" description:"Alert on anomalies only after N weeks of history for the hour are collected"`
+	AnomalyMinIncrease float64 `long:"anomaly-min-increase" value-name:"R" default:"1" description:"Alert on anomalies only when the rate of matched lines is more than R per minute above the baseline"`
+
+	CompareOffset        time.Duration `long:"compare-offset" value-name:"DURATION" description:"Run the query again over the window shifted back by DURATION (e.g. 24h) and compare the matched counts"`
+	CompareWarningRatio  float64       `long:"compare-warning-ratio" value-name:"RATIO" description:"Trigger a warning if matched lines are over RATIO times the count of the shifted window"`
+	CompareCriticalRatio float64       `long:"compare-critical-ratio" value-name:"RATIO" description:"Trigger a critical if matched lines are over RATIO times the count of the shifted window"`
+
+	ConsoleURL bool `long:"console-url" description:"Output a URL of CloudWatch Logs Insights console to run the query on the window when alerting"`
+
+	Output string `long:"output" value-name:"FORMAT" choice:"text" choice:"json" default:"text" description:"Output format. json prints a structured document for machine consumers"`
+
+	MessageTemplate     string `long:"message-template" value-name:"TEMPLATE" description:"Go text/template to build the check message" unquote:"false"`
+	MessageTemplateFile string `long:"message-template-file" value-name:"FILE" description:"File containing Go text/template to build the check message" unquote:"false"`
+
+	Timeout       time.Duration `long:"timeout" value-name:"DURATION" description:"Stop the query if it does not finish within DURATION (e.g. 25s)"`
+	TimeoutStatus string        `long:"timeout-status" value-name:"STATUS" choice:"unknown" choice:"warning" choice:"critical" choice:"last" default:"unknown" description:"Status on timeout unless partial results exceed thresholds. last uses the status of the last run"`
+
+	OnError []string `long:"on-error" value-name:"CLASS=STATUS" description:"Status for errors of CLASS (auth, throttle, query, timeout, state, invalid or other): ok, warning, critical, unknown or last (default: unknown)" unquote:"false"`
+
+	MaxConcurrentQueries int `long:"max-concurrent-queries" value-name:"N" description:"Limit concurrent queries started by plugin processes sharing the state dir"`
+
+	EndpointURL string `long:"endpoint-url" value-name:"URL" description:"Override the CloudWatch Logs endpoint URL" unquote:"false"`
+	NoVerifySSL bool   `long:"no-verify-ssl" description:"Disable verification of TLS certificates"`
+	CABundle    string `long:"ca-bundle" value-name:"FILE" description:"CA certificate bundle to use when verifying TLS certificates" unquote:"false"`
+
+	// adHoc is set by the query subcommand, which prints returned rows instead of counting matches
+	adHoc bool
 }
 
-type cwIface interface {
+// Client is the CloudWatch Logs API used by the check. *cloudwatchlogs.Client satisfies it.
+type Client interface {
 	StartQuery(ctx context.Context, params *cloudwatchlogs.StartQueryInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.StartQueryOutput, error)
 	GetQueryResults(ctx context.Context, params *cloudwatchlogs.GetQueryResultsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetQueryResultsOutput, error)
 	StopQuery(ctx context.Context, params *cloudwatchlogs.StopQueryInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.StopQueryOutput, error)
+	DescribeQueryDefinitions(ctx context.Context, params *cloudwatchlogs.DescribeQueryDefinitionsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeQueryDefinitionsOutput, error)
 }
 
 type awsCWLogsInsightsPlugin struct {
-	Service   cwIface
+	Service   Client
 	StateFile string
+	Region    string
+	// identity distinguishes the accounts and the regions of clients in the keys of the state and the cache
+	identity []string
 	*logOpts
+
+	messageTemplate *template.Template
+	redactor        *redactor
+	// store keeps the state. The state file is read and written directly if nil.
+	store stateStore
+
+	// givenOpts are the options before --query-definition is applied, and nil without it
+	givenOpts *logOpts
+	// definitionExpiry is when --query-definition should be resolved again
+	definitionExpiry time.Time
+	// definitionFresh is true until the first run after --query-definition is loaded by the build
+	definitionFresh bool
 }
 
+// clientFunc returns a CloudWatch Logs client for the options, and its region
+type clientFunc func(ctx context.Context, opts *logOpts) (Client, string, error)
+
 func newCWLogsInsightsPlugin(ctx context.Context, opts *logOpts, args []string) (*awsCWLogsInsightsPlugin, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
+	return newCWLogsInsightsPluginWithClient(ctx, opts, args, newClient, nil)
+}
+
+// newCWLogsInsightsPluginWithClient creates the plugin with the client returned by newClient.
+// identity identifies the account and the region of the client, and is taken from the environment if nil.
+func newCWLogsInsightsPluginWithClient(ctx context.Context, opts *logOpts, args []string, newClient clientFunc, identity []string) (*awsCWLogsInsightsPlugin, error) {
+	if err := opts.validateQuerySource(); err != nil {
+		return nil, withClass(ErrorClassInvalid, err)
+	}
+	// the query loaded from a saved query or rendered as a template is validated after it is built
+	deferCheck := opts.QueryDefinition != "" || opts.isFilterTemplate()
+	if !deferCheck {
+		if err := opts.checkQuery(); err != nil {
+			return nil, err
+		}
+	}
+	service, region, err := newClient(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	p := &awsCWLogsInsightsPlugin{logOpts: opts}
-	p.Service = cloudwatchlogs.NewFromConfig(cfg)
+	if identity == nil {
+		identity = envIdentity()
+	}
+	p := &awsCWLogsInsightsPlugin{Service: service, logOpts: opts, Region: region, identity: identity}
+	p.messageTemplate, err = opts.parseMessageTemplate()
+	if err != nil {
+		return nil, err
+	}
+	p.redactor, err = opts.newRedactor()
+	if err != nil {
+		return nil, err
+	}
 
 	if p.StateDir == "" {
 		workdir := pluginutil.PluginWorkDir()
 		p.StateDir = filepath.Join(workdir, "check-aws-cloudwatch-logs-insights")
 	}
-	p.StateFile = getStateFile(p.StateDir, args)
+
+	stateKey := args
+	if opts.QueryDefinition != "" {
+		if err := p.loadQueryDefinition(ctx, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if opts.isFilterTemplate() {
+		if err := opts.renderFilter(p.Region); err != nil {
+			return nil, withClass(ErrorClassInvalid, err)
+		}
+		// the same arguments may render different queries by the host or the environment
+		stateKey = append(stateKey[:len(stateKey):len(stateKey)], opts.Filter)
+	}
+	if deferCheck {
+		if err := opts.checkQuery(); err != nil {
+			return nil, err
+		}
+	}
+	p.StateFile = getStateFile(p.StateDir, p.identity, stateKey)
 	return p, nil
 }
 
+// newClient loads the AWS config, and creates a CloudWatch Logs client
+func newClient(ctx context.Context, opts *logOpts) (Client, string, error) {
+	loadOpts, err := opts.configLoadOptions()
+	if err != nil {
+		return nil, "", err
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, "", err
+	}
+	client := cloudwatchlogs.NewFromConfig(cfg, func(o *cloudwatchlogs.Options) {
+		if opts.EndpointURL != "" {
+			o.BaseEndpoint = aws.String(opts.EndpointURL)
+		}
+	})
+	return client, cfg.Region, nil
+}
+
+// configLoadOptions returns options for config.LoadDefaultConfig to apply TLS settings
+func (opts *logOpts) configLoadOptions() ([]func(*config.LoadOptions) error, error) {
+	var loadOpts []func(*config.LoadOptions) error
+	if opts.NoVerifySSL {
+		client := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.InsecureSkipVerify = true
+		})
+		loadOpts = append(loadOpts, config.WithHTTPClient(client))
+	}
+	if opts.CABundle != "" {
+		b, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		loadOpts = append(loadOpts, config.WithCustomCABundle(bytes.NewReader(b)))
+	}
+	return loadOpts, nil
+}
+
 func (p *awsCWLogsInsightsPlugin) buildChecker(res *ParsedQueryResults) *checkers.Checker {
+	status, summary := p.evaluate(res)
+	return p.newChecker(status, summary, res)
+}
+
+// evaluate returns the status of res by the thresholds, and the summary line of it
+func (p *awsCWLogsInsightsPlugin) evaluate(res *ParsedQueryResults) (checkers.Status, string) {
 	status := checkers.OK
 	var msg string
 	if res.MatchedCount > p.CriticalOver {
@@ -85,13 +252,58 @@ func (p *awsCWLogsInsightsPlugin) buildChecker(res *ParsedQueryResults) *checker
 	} else {
 		msg = fmt.Sprintf("%d messages", res.MatchedCount)
 	}
+	if res.Partial {
+		msg += " (partial result: query did not finish in time)"
+	}
+	return status, msg
+}
+
+// newChecker builds the check message from the summary line and res
+func (p *awsCWLogsInsightsPlugin) newChecker(status checkers.Status, msg string, res *ParsedQueryResults) *checkers.Checker {
+	var url string
+	// the console link opens the query as CloudWatch Logs Insights QL
+	if p.ConsoleURL && status != checkers.OK && !p.isOpenSearchLanguage() {
+		url = consoleURL(p.Region, p.LogGroupNames, p.fullQuery(), res.StartTime, res.EndTime)
+	}
+	if p.messageTemplate != nil {
+		rendered, err := p.renderMessage(status, msg, url, res)
+		if err == nil {
+			return checkers.NewChecker(status, rendered)
+		}
+		logger.Warningf("failed to render the message template: %v", err)
+		msg += fmt.Sprintf(" (failed to render the message template: %v)", err)
+	}
+	if url != "" {
+		msg += "\n" + url
+	}
 	if status != checkers.OK && p.ReturnMessage {
-		msg += "\n" + strings.Join(res.ReturnedMessages, "\n")
+		msg = p.appendMessages(msg, res)
 	}
 	return checkers.NewChecker(status, msg)
 }
 
-func (p *awsCWLogsInsightsPlugin) searchLogs(ctx context.Context, currentTimestamp time.Time, interval time.Duration) (*ParsedQueryResults, error) {
+// runQueries searches the window, and the window shifted by --compare-offset.
+// A slot of --max-concurrent-queries is held over both of the queries.
+func (p *awsCWLogsInsightsPlugin) runQueries(ctx context.Context, currentTimestamp time.Time, poll *pollStrategy) (*ParsedQueryResults, *comparison, error) {
+	if p.MaxConcurrentQueries > 0 {
+		slot, err := newQuerySemaphore(p.StateDir, p.MaxConcurrentQueries).acquire(ctx, poll)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to acquire query slot: %w", err)
+		}
+		defer func() {
+			if err := slot.release(); err != nil {
+				logger.Warningf("failed to release query slot: %v", err)
+			}
+		}()
+	}
+	res, err := p.searchLogs(ctx, currentTimestamp, poll)
+	if err != nil {
+		return res, nil, err
+	}
+	return res, p.compare(ctx, res, poll), nil
+}
+
+func (p *awsCWLogsInsightsPlugin) searchLogs(ctx context.Context, currentTimestamp time.Time, poll *pollStrategy) (*ParsedQueryResults, error) {
 	// Considering delay in CloudWatch Logs Insights, endTime is 5 minutes prior current timestamp
 	endTime := currentTimestamp.Add(-5 * time.Minute)
 	startTime := endTime.Add(-1 * time.Minute)
@@ -99,7 +311,7 @@ func (p *awsCWLogsInsightsPlugin) searchLogs(ctx context.Context, currentTimesta
 	// If state file found, set startTime to last endTime
 	lastState, err := p.loadState()
 	if err != nil && !os.IsNotExist(err) {
-		return nil, fmt.Errorf("failed to load plugin state: %w", err)
+		return nil, withClass(ErrorClassState, fmt.Errorf("failed to load plugin state: %w", err))
 	}
 	if lastState != nil && lastState.EndTime != 0 {
 		lastEndTime := time.Unix(lastState.EndTime, 0)
@@ -114,65 +326,143 @@ func (p *awsCWLogsInsightsPlugin) searchLogs(ctx context.Context, currentTimesta
 	nextState := &logState{
 		EndTime: endTime.Unix(),
 	}
+	if lastState != nil {
+		nextState.LastStatus = lastState.LastStatus
+		nextState.History = lastState.History
+	}
 
-	queryID, err := p.startQuery(ctx, startTime, endTime)
+	queryID, err := p.startQueryWithRetry(ctx, startTime, endTime, poll)
 	if err != nil {
 		return nil, fmt.Errorf("failed to start query: %w", err)
 	}
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	res, err := p.waitQuery(ctx, queryID, startTime, endTime, poll, nil)
+	if err != nil {
+		// The state is not advanced since the window was not fully evaluated.
+		return res, err
+	}
+	if res.FailureReason != "" {
+		if saveStateErr := p.saveState(nextState); saveStateErr != nil {
+			logger.Errorf("failed to save state file: %v", saveStateErr)
+		}
+		return nil, withClass(ErrorClassQuery, errors.New(res.FailureReason))
+	}
+	if saveStateErr := p.saveState(nextState); saveStateErr != nil {
+		return nil, withClass(ErrorClassState, fmt.Errorf("failed to save state file: %w", saveStateErr))
+	}
+	return res, nil
+}
+
+// waitQuery polls the results of the query on the time range until it finishes, calling progress on each poll.
+// A finished query is returned with its FailureReason even if it failed.
+// When ctx is done, the query is stopped. If the deadline is exceeded,
+// the latest results of the running query are returned as partial along with the error.
+func (p *awsCWLogsInsightsPlugin) waitQuery(ctx context.Context, queryID *string, startTime, endTime time.Time, poll *pollStrategy, progress func(*ParsedQueryResults)) (*ParsedQueryResults, error) {
+	poller := poll.start("GetQueryResults")
+	// partial keeps the latest results of the running query
+	var partial *ParsedQueryResults
 	for {
 		select {
 		case <-ctx.Done():
 			err := ctx.Err()
+			if errors.Is(err, context.DeadlineExceeded) {
+				if res := p.fetchLastResults(queryID); res != nil {
+					res.QueryID = aws.ToString(queryID)
+					res.StartTime, res.EndTime = startTime, endTime
+					if res.Finished && res.FailureReason == "" {
+						logger.Infof("query finished just at the deadline")
+						return res, nil
+					}
+					if !res.Finished {
+						partial = res
+					}
+				}
+			}
 			// Cancel current query.
 			logger.Infof("execution cancelled. Will send StopQuery to stop the running query.")
-			if saveStateErr := p.saveState(nextState); saveStateErr != nil {
-				logger.Errorf("failed to save state file: %v", saveStateErr)
-			}
 			if stopQueryErr := p.stopQuery(queryID); stopQueryErr != nil {
 				logger.Errorf("failed to stop the running query: %v", stopQueryErr)
 			} else {
 				logger.Debugf("succeeded to cancel query")
 			}
-			return nil, err
-		case <-ticker.C:
+			if partial == nil || !errors.Is(err, context.DeadlineExceeded) {
+				return nil, err
+			}
+			partial.Partial = true
+			return partial, err
+		case <-poller.wait():
 			logger.Debugf("Try to GetQueryResults...")
 			out, err := p.getQueryResults(ctx, queryID)
 			if err != nil {
+				if giveUpErr := poller.fail(err); giveUpErr != nil {
+					return nil, p.giveUpQuery(queryID, giveUpErr)
+				}
 				logger.Warningf("GetQueryResults failed (will retry): %v", err)
 				continue
 			}
-			res, err := parseResult(out)
+			res, err := p.parseQueryResults(out)
 			if err != nil {
+				if giveUpErr := poller.fail(err); giveUpErr != nil {
+					return nil, p.giveUpQuery(queryID, giveUpErr)
+				}
 				logger.Warningf("failed to parse GetQueryResults response (will retry): %v", err)
 				continue
 			}
+			poller.succeed()
+			res.QueryID = aws.ToString(queryID)
+			res.StartTime, res.EndTime = startTime, endTime
+			if progress != nil {
+				progress(res)
+			}
 			if !res.Finished {
 				logger.Debugf("Query not finished. Will wait a while...")
+				partial = res
 				continue
 			}
 			logger.Debugf("Query finished! got result: %v", out)
-			if res.FailureReason != "" {
-				if saveStateErr := p.saveState(nextState); saveStateErr != nil {
-					logger.Errorf("failed to save state file: %v", saveStateErr)
-				}
-				return nil, errors.New(res.FailureReason)
-			}
-			if saveStateErr := p.saveState(nextState); saveStateErr != nil {
-				return nil, fmt.Errorf("failed to save state file: %w", saveStateErr)
-			}
 			return res, nil
 		}
 	}
 }
 
+// fetchLastResults gets results of the query after the deadline of the execution.
+// It returns nil if it fails.
+func (p *awsCWLogsInsightsPlugin) fetchLastResults(queryID *string) *ParsedQueryResults {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := p.getQueryResults(ctx, queryID)
+	if err != nil {
+		logger.Warningf("failed to get results after the deadline: %v", err)
+		return nil
+	}
+	res, err := p.parseQueryResults(out)
+	if err != nil {
+		logger.Warningf("failed to parse GetQueryResults response after the deadline: %v", err)
+		return nil
+	}
+	return res
+}
+
+// giveUpQuery stops the query which is given up polling, and returns err.
+// The state is left as is so that the next run searches the window again.
+func (p *awsCWLogsInsightsPlugin) giveUpQuery(queryID *string, err error) error {
+	if stopQueryErr := p.stopQuery(queryID); stopQueryErr != nil {
+		logger.Errorf("failed to stop the running query: %v", stopQueryErr)
+	}
+	return err
+}
+
 // fullQuery returns p.Filter with additional commands for searching Logs
 func (p *awsCWLogsInsightsPlugin) fullQuery() string {
 	fullQuery := p.Filter
 	// GetQueryResults returns @message (,@timestamp and @ptr) by default, but add `fields @message` explicitly for safety
-	if p.ReturnMessage {
-		fullQuery = fullQuery + " | fields @message"
+	// SQL queries select fields by themselves
+	// Rows aggregated by the query subcommand have no @message, and are printed as they are
+	if p.ReturnMessage && p.QueryLanguage != "sql" && !(p.adHoc && aggregates(fullQuery)) {
+		if p.GroupMessages && p.GroupServerSide {
+			return fullQuery + " | pattern @message"
+		}
+		fields := append(p.returnFields(), "@message")
+		fullQuery = fullQuery + p.fieldsCommand(fields)
 	}
 	return fullQuery
 }
@@ -185,7 +475,8 @@ func (p *awsCWLogsInsightsPlugin) startQuery(ctx context.Context, startTime, end
 		StartTime:     aws.Int64(startTime.Unix()),
 		LogGroupNames: p.LogGroupNames,
 		QueryString:   aws.String(p.fullQuery()),
-		Limit:         aws.Int32(10),
+		Limit:         aws.Int32(int32(p.returnLimit())),
+		QueryLanguage: queryLanguages[p.QueryLanguage],
 	}
 	logger.Debugf("start query, %v", input)
 	q, err := p.Service.StartQuery(ctx, input)
@@ -195,6 +486,21 @@ func (p *awsCWLogsInsightsPlugin) startQuery(ctx context.Context, startTime, end
 	return q.QueryId, nil
 }
 
+// startQueryWithRetry calls startQuery, and retries it with backoff
+// while StartQuery fails by throttling or the limit of concurrent queries
+func (p *awsCWLogsInsightsPlugin) startQueryWithRetry(ctx context.Context, startTime, endTime time.Time, poll *pollStrategy) (*string, error) {
+	retrier := poll.start("StartQuery")
+	for {
+		queryID, err := p.startQuery(ctx, startTime, endTime)
+		if err == nil || !isThrottlingError(err) {
+			return queryID, err
+		}
+		if err := retrier.retry(ctx, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
 // getQueryResults calls cloudwatchlogs.GetQueryResults()
 func (p *awsCWLogsInsightsPlugin) getQueryResults(ctx context.Context, queryID *string) (*cloudwatchlogs.GetQueryResultsOutput, error) {
 	return p.Service.GetQueryResults(ctx, &cloudwatchlogs.GetQueryResultsInput{
@@ -208,6 +514,42 @@ type ParsedQueryResults struct {
 	FailureReason    string
 	MatchedCount     int
 	ReturnedMessages []string
+	// Partial is true when the query did not finish and results are partial
+	Partial bool
+	// Rows are returned rows with all of their fields
+	Rows       []ResultRow
+	Statistics QueryStatistics
+	// QueryID is the ID of the query
+	QueryID string
+	// StartTime and EndTime are the window searched by the query
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// ResultField is a field of a returned row
+type ResultField struct {
+	Name  string
+	Value string
+}
+
+// ResultRow is a returned row, keeping the order of fields
+type ResultRow []ResultField
+
+// Field returns the value of the named field, or an empty string if the row doesn't have it
+func (r ResultRow) Field(name string) string {
+	for _, f := range r {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// QueryStatistics is statistics of the query
+type QueryStatistics struct {
+	RecordsMatched float64
+	RecordsScanned float64
+	BytesScanned   float64
 }
 
 // parseResult parses *cloudwatchlogs.GetQueryResultsOutput for checking logs
@@ -232,13 +574,26 @@ func parseResult(out *cloudwatchlogs.GetQueryResultsOutput) (*ParsedQueryResults
 
 	if out.Statistics != nil {
 		res.MatchedCount = int(out.Statistics.RecordsMatched)
+		res.Statistics = QueryStatistics{
+			RecordsMatched: out.Statistics.RecordsMatched,
+			RecordsScanned: out.Statistics.RecordsScanned,
+			BytesScanned:   out.Statistics.BytesScanned,
+		}
 	}
 
 	res.ReturnedMessages = []string{}
+	res.Rows = []ResultRow{}
 	for _, fields := range out.Results {
+		row := make(ResultRow, 0, len(fields))
 		for _, field := range fields {
-			if field.Field != nil && *field.Field == "@message" && field.Value != nil {
-				res.ReturnedMessages = append(res.ReturnedMessages, *field.Value)
+			if field.Field != nil && field.Value != nil {
+				row = append(row, ResultField{Name: *field.Field, Value: *field.Value})
+			}
+		}
+		res.Rows = append(res.Rows, row)
+		for _, field := range row {
+			if field.Name == "@message" {
+				res.ReturnedMessages = append(res.ReturnedMessages, field.Value)
 				break
 			}
 		}
@@ -257,21 +612,25 @@ func (p *awsCWLogsInsightsPlugin) stopQuery(queryID *string) error {
 
 type logState struct {
 	EndTime int64
+	// LastStatus is the status of the last evaluated window
+	LastStatus string `json:",omitempty"`
+	// History is the results of recent runs, oldest first
+	History []runRecord `json:",omitempty"`
 }
 
-func getStateFile(stateDir string, args []string) string {
+// envIdentity identifies the account and the region of the client created from the AWS config
+func envIdentity() []string {
+	return []string{os.Getenv("AWS_PROFILE"), os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_REGION")}
+}
+
+func getStateFile(stateDir string, identity, args []string) string {
 	return filepath.Join(
 		stateDir,
 		fmt.Sprintf(
 			"%x.json",
 			md5.Sum([]byte(
 				strings.Join(
-					[]string{
-						os.Getenv("AWS_PROFILE"),
-						os.Getenv("AWS_ACCESS_KEY_ID"),
-						os.Getenv("AWS_REGION"),
-						strings.Join(args, " "),
-					},
+					append(identity[:len(identity):len(identity)], strings.Join(args, " ")),
 					" ",
 				)),
 			),
@@ -279,15 +638,16 @@ func getStateFile(stateDir string, args []string) string {
 	)
 }
 
-func (p *awsCWLogsInsightsPlugin) loadState() (*logState, error) {
-	f, err := os.Open(p.StateFile)
-	if err != nil {
-		return nil, err
+func (p *awsCWLogsInsightsPlugin) stateStore() stateStore {
+	if p.store == nil {
+		return fileStateStore{}
 	}
-	defer f.Close()
+	return p.store
+}
+
+func (p *awsCWLogsInsightsPlugin) loadState() (*logState, error) {
 	var s logState
-	err = json.NewDecoder(f).Decode(&s)
-	if err != nil {
+	if err := loadJSON(p.stateStore(), p.StateFile, &s); err != nil {
 		return nil, err
 	}
 	logger.Debugf("Loaded state from stateFile %s: %#v", p.StateFile, s)
@@ -296,33 +656,85 @@ func (p *awsCWLogsInsightsPlugin) loadState() (*logState, error) {
 
 func (p *awsCWLogsInsightsPlugin) saveState(s *logState) error {
 	logger.Debugf("Saving state to stateFile %s: %#v", p.StateFile, s)
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(s); err != nil {
-		return err
+	return saveJSON(p.stateStore(), p.StateFile, s)
+}
+
+// timeoutChecker builds a result when the query did not finish within --timeout.
+// --on-error timeout=STATUS takes precedence over --timeout-status.
+func (p *awsCWLogsInsightsPlugin) timeoutChecker(partial *ParsedQueryResults) *checkers.Checker {
+	msg := fmt.Sprintf("[%s] query did not finish within %s", ErrorClassTimeout, p.Timeout)
+	if partial != nil {
+		// matched count only grows as the query proceeds, so exceeded thresholds are reliable.
+		// They are reported through --min-consecutive as breaches of complete runs are.
+		if status, summary := p.evaluate(partial); status != checkers.OK {
+			return p.applyHistory(status, summary, partial)
+		}
+		msg += fmt.Sprintf(" (%d messages in partial result)", partial.MatchedCount)
 	}
-	if err := os.MkdirAll(filepath.Dir(p.StateFile), 0755); err != nil {
-		return err
+	name := p.TimeoutStatus
+	if s, ok := p.onErrorStatus(ErrorClassTimeout); ok {
+		name = s
 	}
-	return atomic.WriteFile(p.StateFile, &buf)
+	status, kept := resolveStatus(name, p.lastStatus)
+	if kept {
+		msg += ", keeping the last status"
+	}
+	return checkers.NewChecker(status, msg)
+}
+
+var statusByName = map[string]checkers.Status{
+	checkers.OK.String():       checkers.OK,
+	checkers.WARNING.String():  checkers.WARNING,
+	checkers.CRITICAL.String(): checkers.CRITICAL,
+	checkers.UNKNOWN.String():  checkers.UNKNOWN,
 }
 
-func (p *awsCWLogsInsightsPlugin) run(ctx context.Context) *checkers.Checker {
-	now := time.Now()
-	res, err := p.searchLogs(ctx, now, 1*time.Second)
+func (p *awsCWLogsInsightsPlugin) run(ctx context.Context) *checkResult {
+	res, cmp, err := p.runQueries(ctx, time.Now(), defaultPollStrategy())
+	if res != nil && p.redactor != nil {
+		p.redactor.redactResults(res)
+	}
+	r := &checkResult{opts: p.logOpts, res: res, cmp: cmp, err: err}
+	if errors.Is(err, context.DeadlineExceeded) {
+		r.Checker = p.timeoutChecker(res)
+		return r
+	}
 	if err != nil {
-		return checkers.Unknown(err.Error())
+		r.Checker = p.errorChecker(err, p.lastStatus)
+		return r
 	}
-	return p.buildChecker(res)
+	r.Checker = p.evaluateWithHistory(res, r.cmp)
+	return r
+}
+
+// subcommands are run by the first argument instead of the check
+var subcommands = map[string]func(args []string) int{
+	"query":    queryCommand,
+	"validate": validateCommand,
+	"serve":    serveCommand,
+	"check":    checkCommand,
 }
 
 // Do the logic
 func Do() {
-	ckr := run(os.Args[1:])
-	ckr.Name = "CloudWatch Logs Insights"
-	ckr.Exit()
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+	r := run(os.Args[1:])
+	r.Name = "CloudWatch Logs Insights"
+	if r.opts.Output == "json" {
+		if err := r.writeJSON(os.Stdout); err != nil {
+			logger.Errorf("failed to write the result: %v", err)
+			os.Exit(int(checkers.UNKNOWN))
+		}
+		os.Exit(int(r.Status))
+	}
+	r.Exit()
 }
 
-func run(args []string) *checkers.Checker {
+func run(args []string) *checkResult {
 	opts := &logOpts{}
 	_, err := flags.ParseArgs(opts, args)
 	if err != nil {
@@ -334,18 +746,22 @@ func run(args []string) *checkers.Checker {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
 
-	p, err := newCWLogsInsightsPlugin(ctx, opts, args)
+	c, err := newChecker(ctx, opts, args, &checkerConfig{newClient: newClient})
 	if err != nil {
-		return checkers.Unknown(err.Error())
+		return newErrorResult(opts, err)
 	}
 
 	// on termination, call cancel
-	resCh := make(chan *checkers.Checker, 1)
+	resCh := make(chan *checkResult, 1)
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
 	go func() {
-		resCh <- p.run(ctx)
+		resCh <- c.run(ctx)
 	}()
 	select {
 	case res := <-resCh:
@@ -358,7 +774,7 @@ func run(args []string) *checkers.Checker {
 			return res
 		case <-sigCh:
 			logger.Errorf("Received signal again. force shutdown.")
-			return checkers.Unknown("terminated by signal")
+			return newErrorResult(opts, errors.New("terminated by signal"))
 		}
 	}
 }
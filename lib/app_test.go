@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"os"
 	"path/filepath"
@@ -14,13 +15,15 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/smithy-go"
+	"github.com/mackerelio/check-aws-cloudwatch-logs-insights/internal/fakecwlogs"
 	"github.com/mackerelio/checkers"
 	"github.com/stretchr/testify/mock"
 )
 
 func Test_awsCWLogsInsightsPlugin_buildChecker(t *testing.T) {
 	type fields struct {
-		Service   cwIface
+		Service   Client
 		StateFile string
 		logOpts   *logOpts
 	}
@@ -128,7 +131,7 @@ func Test_awsCWLogsInsightsPlugin_buildChecker(t *testing.T) {
 					ReturnedMessages: []string{"this-is-returned-message", "this-is-also-returned-message"},
 				},
 			},
-			want: checkers.Critical("5 > 4 messages\nthis-is-returned-message\nthis-is-also-returned-message"),
+			want: checkers.Critical("5 > 4 messages\nthis-is-returned-message\nthis-is-also-returned-message\n(3 more)"),
 		},
 		{
 			name: "will not include ReturnedMessage when ReturnMessage: false",
@@ -146,12 +149,35 @@ func Test_awsCWLogsInsightsPlugin_buildChecker(t *testing.T) {
 				},
 			},
 			want: checkers.Critical("5 > 4 messages"),
+		},
+		{
+			name: "will include console URL when ConsoleURL: true",
+			fields: fields{
+				logOpts: &logOpts{
+					LogGroupNames: []string{"/log/foo"},
+					Filter:        "filter @message like /omg/",
+					CriticalOver:  4,
+					WarningOver:   2,
+					ConsoleURL:    true,
+				},
+			},
+			args: args{
+				res: &ParsedQueryResults{
+					MatchedCount: 5,
+					StartTime:    time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC),
+					EndTime:      time.Date(2020, 10, 12, 3, 1, 0, 0, time.UTC),
+				},
+			},
+			want: checkers.Critical("5 > 4 messages\nhttps://us-east-1.console.aws.amazon.com/cloudwatch/home?region=us-east-1#logsV2:logs-insights$3FqueryDetail$3D" +
+				"~(end~'2020-10-12T03*3a01*3a00.000Z~start~'2020-10-12T03*3a00*3a00.000Z~timeType~'ABSOLUTE~tz~'UTC" +
+				"~editorString~'filter*20*40message*20like*20*2fomg*2f~source~(~'*2flog*2ffoo))"),
 		}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &awsCWLogsInsightsPlugin{
 				Service:   tt.fields.Service,
 				StateFile: tt.fields.StateFile,
+				Region:    "us-east-1",
 				logOpts:   tt.fields.logOpts,
 			}
 			if got := p.buildChecker(tt.args.res); !reflect.DeepEqual(got, tt.want) {
@@ -162,7 +188,7 @@ func Test_awsCWLogsInsightsPlugin_buildChecker(t *testing.T) {
 }
 
 type mockAWSCloudWatchLogsClient struct {
-	cwIface
+	Client
 	mock.Mock
 }
 
@@ -178,6 +204,18 @@ func (c *mockAWSCloudWatchLogsClient) GetQueryResults(_ context.Context, input *
 	return res, args.Error(1)
 }
 
+func (c *mockAWSCloudWatchLogsClient) DescribeQueryDefinitions(_ context.Context, input *cloudwatchlogs.DescribeQueryDefinitionsInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeQueryDefinitionsOutput, error) {
+	args := c.Called(input)
+	res, _ := args.Get(0).(*cloudwatchlogs.DescribeQueryDefinitionsOutput)
+	return res, args.Error(1)
+}
+
+func (c *mockAWSCloudWatchLogsClient) StopQuery(_ context.Context, input *cloudwatchlogs.StopQueryInput, _ ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.StopQueryOutput, error) {
+	args := c.Called(input)
+	res, _ := args.Get(0).(*cloudwatchlogs.StopQueryOutput)
+	return res, args.Error(1)
+}
+
 func Test_parseResult(t *testing.T) {
 	type args struct {
 		out *cloudwatchlogs.GetQueryResultsOutput
@@ -196,6 +234,10 @@ func Test_parseResult(t *testing.T) {
 			},
 		},
 	}
+	simpleRows := []ResultRow{
+		{{Name: "@message", Value: "msg-1"}},
+		{{Name: "@message", Value: "msg-2"}},
+	}
 	tests := []struct {
 		name    string
 		args    args
@@ -217,6 +259,8 @@ func Test_parseResult(t *testing.T) {
 				Finished:         true, // complete
 				MatchedCount:     25,
 				ReturnedMessages: []string{"msg-1", "msg-2"},
+				Rows:             simpleRows,
+				Statistics:       QueryStatistics{RecordsMatched: 25},
 			},
 			wantErr: false,
 		},
@@ -234,6 +278,7 @@ func Test_parseResult(t *testing.T) {
 				FailureReason:    "query was finished with `Failed` status",
 				MatchedCount:     0,
 				ReturnedMessages: []string{},
+				Rows:             []ResultRow{},
 			},
 			wantErr: false,
 		},
@@ -253,6 +298,8 @@ func Test_parseResult(t *testing.T) {
 				FailureReason:    "query was finished with `Cancelled` status",
 				MatchedCount:     25,
 				ReturnedMessages: []string{},
+				Rows:             []ResultRow{},
+				Statistics:       QueryStatistics{RecordsMatched: 25},
 			},
 			wantErr: false,
 		},
@@ -269,6 +316,7 @@ func Test_parseResult(t *testing.T) {
 				Finished:         false, // running
 				MatchedCount:     0,
 				ReturnedMessages: []string{},
+				Rows:             []ResultRow{},
 			},
 			wantErr: false,
 		},
@@ -287,6 +335,8 @@ func Test_parseResult(t *testing.T) {
 				Finished:         true, // complete
 				MatchedCount:     25,
 				ReturnedMessages: []string{"msg-1", "msg-2"},
+				Rows:             simpleRows,
+				Statistics:       QueryStatistics{RecordsMatched: 25},
 			},
 			wantErr: false,
 		},
@@ -337,6 +387,9 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 			RecordsMatched: 6,
 		},
 	}
+	completeRows := []ResultRow{
+		{{Name: "@message", Value: "omg something happend"}},
+	}
 	tests := []struct {
 		name             string
 		fields           fields
@@ -356,6 +409,8 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Finished:         true,
 				MatchedCount:     6,
 				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
 			},
 			wantErr: false,
 			wantNextLogState: &logState{
@@ -374,6 +429,8 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Finished:         true,
 				MatchedCount:     6,
 				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
 			},
 			wantErr: false,
 			wantNextLogState: &logState{
@@ -398,6 +455,8 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Finished:         true,
 				MatchedCount:     6,
 				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
 			},
 			wantErr: false,
 			wantNextLogState: &logState{
@@ -419,6 +478,8 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Finished:         true,
 				MatchedCount:     6,
 				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
 			},
 			wantErr: false,
 			wantNextLogState: &logState{
@@ -432,6 +493,37 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Limit:         aws.Int32(10),
 			},
 		},
+		{
+			name: "with ReturnFields",
+			fields: fields{
+				logOpts: &logOpts{
+					LogGroupNames: []string{"/log/foo", "/log/baz"},
+					Filter:        "filter @message like /omg/",
+					ReturnMessage: true,
+					ReturnFields:  []string{"@timestamp,@logStream"},
+				},
+			},
+			responses: []*cloudwatchlogs.GetQueryResultsOutput{completeOutput},
+			logState:  nil,
+			want: &ParsedQueryResults{
+				Finished:         true,
+				MatchedCount:     6,
+				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
+			},
+			wantErr: false,
+			wantNextLogState: &logState{
+				EndTime: now.Add(-5 * time.Minute).Unix(),
+			},
+			wantInput: &cloudwatchlogs.StartQueryInput{
+				StartTime:     aws.Int64(now.Add(-6 * time.Minute).Unix()),
+				EndTime:       aws.Int64(now.Add(-5 * time.Minute).Unix()),
+				LogGroupNames: []string{"/log/foo", "/log/baz"},
+				QueryString:   aws.String("filter @message like /omg/ | fields @timestamp, @logStream, @message"),
+				Limit:         aws.Int32(10),
+			},
+		},
 		{
 			name:   "GetQueryResults failed",
 			fields: defaultFields,
@@ -466,6 +558,8 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Finished:         true,
 				MatchedCount:     6,
 				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
 			},
 			wantErr: false,
 			wantNextLogState: &logState{
@@ -485,6 +579,8 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Finished:         true,
 				MatchedCount:     6,
 				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
 			},
 			wantErr: false,
 			wantNextLogState: &logState{
@@ -508,6 +604,8 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				Finished:         true,
 				MatchedCount:     6,
 				ReturnedMessages: []string{"omg something happend"},
+				Rows:             completeRows,
+				Statistics:       QueryStatistics{RecordsMatched: 6},
 			},
 			wantErr: false,
 			wantNextLogState: &logState{
@@ -515,6 +613,43 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 			},
 			wantInput: defaultWantInput,
 		},
+		{
+			name: "SQL COUNT(*)",
+			fields: fields{
+				logOpts: &logOpts{
+					QueryLanguage: "sql",
+					Filter:        "SELECT COUNT(*) FROM `logGroups(logGroupIdentifier: ['/log/foo'])` WHERE level = 'error'",
+				},
+			},
+			responses: []*cloudwatchlogs.GetQueryResultsOutput{
+				{
+					Status: types.QueryStatusComplete,
+					Results: [][]types.ResultField{
+						{{Field: aws.String("COUNT(*)"), Value: aws.String("3")}},
+					},
+					Statistics: &types.QueryStatistics{RecordsMatched: 6},
+				},
+			},
+			logState: nil,
+			want: &ParsedQueryResults{
+				Finished:         true,
+				MatchedCount:     3,
+				ReturnedMessages: []string{},
+				Rows:             []ResultRow{{{Name: "COUNT(*)", Value: "3"}}},
+				Statistics:       QueryStatistics{RecordsMatched: 6},
+			},
+			wantErr: false,
+			wantNextLogState: &logState{
+				EndTime: now.Add(-5 * time.Minute).Unix(),
+			},
+			wantInput: &cloudwatchlogs.StartQueryInput{
+				StartTime:     aws.Int64(now.Add(-6 * time.Minute).Unix()),
+				EndTime:       aws.Int64(now.Add(-5 * time.Minute).Unix()),
+				QueryString:   aws.String("SELECT COUNT(*) FROM `logGroups(logGroupIdentifier: ['/log/foo'])` WHERE level = 'error'"),
+				Limit:         aws.Int32(10),
+				QueryLanguage: types.QueryLanguageSql,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -545,11 +680,20 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 				StateFile: filename,
 				logOpts:   tt.fields.logOpts,
 			}
-			got, err := p.searchLogs(context.TODO(), now, time.Millisecond)
+			got, err := p.searchLogs(context.TODO(), now, newTestPollStrategy())
 			if (err != nil) != tt.wantErr {
 				t.Errorf("awsCWLogsInsightsPlugin.searchLogs() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if got != nil {
+				if got.StartTime.Unix() != *tt.wantInput.StartTime || got.EndTime.Unix() != *tt.wantInput.EndTime {
+					t.Errorf("awsCWLogsInsightsPlugin.searchLogs() window = [%v, %v], want [%d, %d]", got.StartTime, got.EndTime, *tt.wantInput.StartTime, *tt.wantInput.EndTime)
+				}
+				if got.QueryID != "DUMMY-QUERY-ID" {
+					t.Errorf("awsCWLogsInsightsPlugin.searchLogs() QueryID = %q, want %q", got.QueryID, "DUMMY-QUERY-ID")
+				}
+				got.StartTime, got.EndTime, got.QueryID = time.Time{}, time.Time{}, ""
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("awsCWLogsInsightsPlugin.searchLogs() = %v, want %v", got, tt.want)
 			}
@@ -569,3 +713,359 @@ func Test_awsCWLogsInsightsPlugin_searchLogs(t *testing.T) {
 		})
 	}
 }
+
+func Test_awsCWLogsInsightsPlugin_fullQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		logOpts *logOpts
+		want    string
+	}{
+		{
+			name:    "filter only",
+			logOpts: &logOpts{Filter: "filter @message like /omg/"},
+			want:    "filter @message like /omg/",
+		},
+		{
+			name:    "with ReturnMessage",
+			logOpts: &logOpts{Filter: "filter @message like /omg/", ReturnMessage: true},
+			want:    "filter @message like /omg/ | fields @message",
+		},
+		{
+			name:    "with ReturnFields",
+			logOpts: &logOpts{Filter: "filter @message like /omg/", ReturnMessage: true, ReturnFields: []string{"@timestamp", "level"}},
+			want:    "filter @message like /omg/ | fields @timestamp, level, @message",
+		},
+		{
+			name:    "with GroupServerSide",
+			logOpts: &logOpts{Filter: "filter @message like /omg/", ReturnMessage: true, GroupMessages: true, GroupServerSide: true},
+			want:    "filter @message like /omg/ | pattern @message",
+		},
+		{
+			name:    "PPL with ReturnFields",
+			logOpts: &logOpts{QueryLanguage: "ppl", Filter: "where level = 'error'", ReturnMessage: true, ReturnFields: []string{"@timestamp"}},
+			want:    "where level = 'error' | fields `@timestamp`, `@message`",
+		},
+		{
+			name:    "SQL with ReturnMessage",
+			logOpts: &logOpts{QueryLanguage: "sql", Filter: "SELECT `@message` FROM `logGroups(logGroupIdentifier: ['/log/foo'])`", ReturnMessage: true},
+			want:    "SELECT `@message` FROM `logGroups(logGroupIdentifier: ['/log/foo'])`",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsCWLogsInsightsPlugin{logOpts: tt.logOpts}
+			if got := p.fullQuery(); got != tt.want {
+				t.Errorf("awsCWLogsInsightsPlugin.fullQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_searchLogs_giveUp(t *testing.T) {
+	now := time.Now()
+	filename := filepath.Join(t.TempDir(), "check-aws-cloudwatch-logs-streams-test-searchLogs")
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+		QueryId: aws.String("DUMMY-QUERY-ID"),
+	}, nil)
+	svc.On("GetQueryResults", mock.Anything).Return(nil, errors.New("failed to get")).Times(3)
+	svc.On("StopQuery", &cloudwatchlogs.StopQueryInput{QueryId: aws.String("DUMMY-QUERY-ID")}).Return(&cloudwatchlogs.StopQueryOutput{}, nil).Once()
+	p := &awsCWLogsInsightsPlugin{
+		Service:   svc,
+		StateFile: filename,
+		logOpts: &logOpts{
+			LogGroupNames: []string{"/log/foo"},
+			Filter:        "filter @message like /omg/",
+		},
+	}
+	poll := newTestPollStrategy()
+	poll.MaxFailures = 3
+	got, err := p.searchLogs(context.TODO(), now, poll)
+	if got != nil {
+		t.Errorf("awsCWLogsInsightsPlugin.searchLogs() = %v, want nil", got)
+	}
+	if want := "GetQueryResults failed 3 times in a row: failed to get"; err == nil || err.Error() != want {
+		t.Errorf("awsCWLogsInsightsPlugin.searchLogs() error = %v, want %s", err, want)
+	}
+	svc.AssertExpectations(t)
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("stateFile should not be saved: %v", err)
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_searchLogs_deadline(t *testing.T) {
+	now := time.Now()
+	filename := filepath.Join(t.TempDir(), "check-aws-cloudwatch-logs-streams-test-searchLogs")
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+		QueryId: aws.String("DUMMY-QUERY-ID"),
+	}, nil)
+	svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+		Status: types.QueryStatusRunning,
+		Results: [][]types.ResultField{
+			{{Field: aws.String("@message"), Value: aws.String("omg something happend")}},
+		},
+		Statistics: &types.QueryStatistics{RecordsMatched: 3},
+	}, nil)
+	svc.On("StopQuery", &cloudwatchlogs.StopQueryInput{QueryId: aws.String("DUMMY-QUERY-ID")}).Return(&cloudwatchlogs.StopQueryOutput{}, nil).Once()
+	p := &awsCWLogsInsightsPlugin{
+		Service:   svc,
+		StateFile: filename,
+		logOpts: &logOpts{
+			LogGroupNames: []string{"/log/foo"},
+			Filter:        "filter @message like /omg/",
+		},
+	}
+	poll := newTestPollStrategy()
+	poll.clock = realClock{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	got, err := p.searchLogs(ctx, now, poll)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("awsCWLogsInsightsPlugin.searchLogs() error = %v, want context.DeadlineExceeded", err)
+	}
+	if got != nil {
+		got.StartTime, got.EndTime = time.Time{}, time.Time{}
+	}
+	want := &ParsedQueryResults{
+		QueryID:          "DUMMY-QUERY-ID",
+		MatchedCount:     3,
+		ReturnedMessages: []string{"omg something happend"},
+		Partial:          true,
+		Rows:             []ResultRow{{{Name: "@message", Value: "omg something happend"}}},
+		Statistics:       QueryStatistics{RecordsMatched: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("awsCWLogsInsightsPlugin.searchLogs() = %v, want %v", got, want)
+	}
+	svc.AssertExpectations(t)
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("stateFile should not be advanced: %v", err)
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_timeoutChecker(t *testing.T) {
+	tests := []struct {
+		name          string
+		timeoutStatus string
+		lastStatus    string
+		partial       *ParsedQueryResults
+		want          *checkers.Checker
+	}{
+		{
+			name:          "without partial result",
+			timeoutStatus: "unknown",
+			want:          checkers.Unknown("[timeout] query did not finish within 25s"),
+		},
+		{
+			name:          "partial result exceeding threshold",
+			timeoutStatus: "unknown",
+			partial:       &ParsedQueryResults{MatchedCount: 5, Partial: true},
+			want:          checkers.Critical("5 > 4 messages (partial result: query did not finish in time)"),
+		},
+		{
+			name:          "partial result under thresholds",
+			timeoutStatus: "warning",
+			partial:       &ParsedQueryResults{MatchedCount: 1, Partial: true},
+			want:          checkers.Warning("[timeout] query did not finish within 25s (1 messages in partial result)"),
+		},
+		{
+			name:          "last status",
+			timeoutStatus: "last",
+			lastStatus:    "CRITICAL",
+			want:          checkers.Critical("[timeout] query did not finish within 25s, keeping the last status"),
+		},
+		{
+			name:          "last status without state",
+			timeoutStatus: "last",
+			want:          checkers.Unknown("[timeout] query did not finish within 25s"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "check-aws-cloudwatch-logs-streams-test-timeoutChecker")
+			if tt.lastStatus != "" {
+				b, _ := json.Marshal(&logState{LastStatus: tt.lastStatus})
+				os.WriteFile(filename, b, 0644) // nolint
+			}
+			p := &awsCWLogsInsightsPlugin{
+				StateFile: filename,
+				logOpts: &logOpts{
+					CriticalOver:  4,
+					WarningOver:   2,
+					Timeout:       25 * time.Second,
+					TimeoutStatus: tt.timeoutStatus,
+				},
+			}
+			if got := p.timeoutChecker(tt.partial); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("awsCWLogsInsightsPlugin.timeoutChecker() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_timeoutChecker_minConsecutive(t *testing.T) {
+	lastEndTime := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC).Unix()
+	p := &awsCWLogsInsightsPlugin{
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+		logOpts:   &logOpts{CriticalOver: 5, Timeout: time.Second, TimeoutStatus: "unknown", MinConsecutive: 3, RecoverAfter: 1},
+	}
+	if err := p.saveState(&logState{EndTime: lastEndTime}); err != nil {
+		t.Fatal(err)
+	}
+	partial := &ParsedQueryResults{MatchedCount: 10, Partial: true}
+	wants := []*checkers.Checker{
+		checkers.Ok("10 > 5 messages (partial result: query did not finish in time) (1/3 breaches in a row)"),
+		checkers.Ok("10 > 5 messages (partial result: query did not finish in time) (2/3 breaches in a row)"),
+		checkers.Critical("10 > 5 messages (partial result: query did not finish in time) (3 breaches in a row)"),
+	}
+	for i, want := range wants {
+		if got := p.timeoutChecker(partial); !reflect.DeepEqual(got, want) {
+			t.Errorf("run %d: awsCWLogsInsightsPlugin.timeoutChecker() = %v, want %v", i, got, want)
+		}
+	}
+
+	// the runs are recorded, but the window is searched again by the next run
+	s, err := p.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.EndTime != lastEndTime || s.LastStatus != "CRITICAL" || len(s.History) != len(wants) {
+		t.Errorf("state = %+v", s)
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_startQueryWithRetry(t *testing.T) {
+	limitExceeded := &smithy.GenericAPIError{Code: "LimitExceededException", Message: "Too many concurrent queries"}
+	tests := []struct {
+		name     string
+		errs     []error // errors returned by StartQuery before it succeeds
+		deadline time.Duration
+		wantID   *string
+		wantErr  string
+	}{
+		{
+			name:   "succeeds after LimitExceededException",
+			errs:   []error{limitExceeded, limitExceeded},
+			wantID: aws.String("DUMMY-QUERY-ID"),
+		},
+		{
+			name:    "does not retry other errors",
+			errs:    []error{errors.New("access denied")},
+			wantErr: "access denied",
+		},
+		{
+			name:     "gives up when no time is left",
+			errs:     []error{limitExceeded, limitExceeded},
+			deadline: 1500 * time.Millisecond,
+			wantErr:  "StartQuery failed and no time is left to retry: api error LimitExceededException: Too many concurrent queries",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockAWSCloudWatchLogsClient{}
+			for _, err := range tt.errs {
+				svc.On("StartQuery", mock.Anything).Return(nil, err).Once()
+			}
+			svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+				QueryId: aws.String("DUMMY-QUERY-ID"),
+			}, nil).Maybe()
+			p := &awsCWLogsInsightsPlugin{
+				Service: svc,
+				logOpts: &logOpts{
+					LogGroupNames: []string{"/log/foo"},
+					Filter:        "filter @message like /omg/",
+				},
+			}
+			clk := &fakeClock{now: time.Now()}
+			poll := &pollStrategy{
+				Initial:     1 * time.Second,
+				Max:         10 * time.Second,
+				Multiplier:  2,
+				MaxFailures: 5,
+				clock:       clk,
+			}
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, clk.now.Add(tt.deadline))
+				defer cancel()
+			}
+			got, err := p.startQueryWithRetry(ctx, time.Now(), time.Now(), poll)
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("awsCWLogsInsightsPlugin.startQueryWithRetry() error = %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.wantID) {
+				t.Errorf("awsCWLogsInsightsPlugin.startQueryWithRetry() = %v, want %v", got, tt.wantID)
+			}
+		})
+	}
+}
+
+func Test_run_withEndpointURL(t *testing.T) {
+	t.Setenv("AWS_REGION", "ap-northeast-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "DUMMY-ACCESS-KEY-ID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "DUMMY-SECRET-ACCESS-KEY")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	events := []fakecwlogs.Event{
+		{LogGroupName: "/log/foo", Timestamp: time.Now().Add(-330 * time.Second), Message: "omg something happend"},
+	}
+	plainServer := fakecwlogs.NewServer()
+	defer plainServer.Close()
+	plainServer.AddEvents(events...)
+	tlsServer := fakecwlogs.NewTLSServer()
+	defer tlsServer.Close()
+	tlsServer.AddEvents(events...)
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caBundle, pemCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want checkers.Status
+	}{
+		{
+			name: "plain HTTP endpoint",
+			args: []string{"--endpoint-url", plainServer.URL},
+			want: checkers.CRITICAL,
+		},
+		{
+			name: "TLS endpoint without verification",
+			args: []string{"--endpoint-url", tlsServer.URL, "--no-verify-ssl"},
+			want: checkers.CRITICAL,
+		},
+		{
+			name: "TLS endpoint with custom CA bundle",
+			args: []string{"--endpoint-url", tlsServer.URL, "--ca-bundle", caBundle},
+			want: checkers.CRITICAL,
+		},
+		{
+			name: "TLS endpoint with untrusted certificate",
+			args: []string{"--endpoint-url", tlsServer.URL},
+			want: checkers.UNKNOWN,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{
+				"--log-group-name", "/log/foo",
+				"--filter", "filter @message like /omg/",
+				"--critical-over", "0",
+				"--state-dir", t.TempDir(),
+				"--return",
+			}, tt.args...)
+			ckr := run(args)
+			if ckr.Status != tt.want {
+				t.Fatalf("run() status = %v, want %v: %s", ckr.Status, tt.want, ckr.Message)
+			}
+			if tt.want == checkers.CRITICAL && ckr.Message != "1 > 0 messages\nomg something happend" {
+				t.Errorf("run() message = %q", ckr.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+// baseline is the history of match rates kept for the anomaly mode
+type baseline struct {
+	// Hours are aggregated results per hour, oldest first
+	Hours []hourSample
+}
+
+// hourSample is the aggregated results of windows ending in an hour
+type hourSample struct {
+	// Hour is the unix time of the start of the hour
+	Hour    int64
+	Count   int
+	Minutes float64
+}
+
+func (s hourSample) rate() float64 {
+	if s.Minutes <= 0 {
+		return 0
+	}
+	return float64(s.Count) / s.Minutes
+}
+
+// anomalyEnabled reports whether the anomaly mode is enabled
+func (opts *logOpts) anomalyEnabled() bool {
+	return opts.AnomalyStddev > 0 || opts.AnomalyPercent > 0
+}
+
+// validateAnomaly checks options of the anomaly mode
+func (opts *logOpts) validateAnomaly() error {
+	if opts.AnomalyStddev < 0 || opts.AnomalyPercent < 0 {
+		return errors.New("--anomaly-stddev and --anomaly-percent must be positive")
+	}
+	if opts.AnomalyMinIncrease < 0 {
+		return errors.New("--anomaly-min-increase must be 0 or more")
+	}
+	if opts.AnomalyStddev > 0 && opts.AnomalyPercent > 0 {
+		return errors.New("--anomaly-stddev and --anomaly-percent cannot be used together")
+	}
+	if opts.anomalyEnabled() && (opts.AnomalyMinSamples < 1 || opts.AnomalyWeeks < opts.AnomalyMinSamples) {
+		return errors.New("--anomaly-weeks must be --anomaly-min-samples or more, which must be 1 or more")
+	}
+	return nil
+}
+
+// baselineFile returns the path of the baseline file, next to the state file
+func (p *awsCWLogsInsightsPlugin) baselineFile() string {
+	return strings.TrimSuffix(p.StateFile, ".json") + ".baseline.json"
+}
+
+// loadBaseline loads the baseline through the state store, as the state is
+func (p *awsCWLogsInsightsPlugin) loadBaseline() (*baseline, error) {
+	b := &baseline{}
+	if err := loadJSON(p.stateStore(), p.baselineFile(), b); err != nil {
+		if os.IsNotExist(err) {
+			return &baseline{}, nil
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (p *awsCWLogsInsightsPlugin) saveBaseline(b *baseline) error {
+	return saveJSON(p.stateStore(), p.baselineFile(), b)
+}
+
+// samplesAt returns samples of the same hour of the week as t in the past weeks
+func (b *baseline) samplesAt(t time.Time, weeks int) []hourSample {
+	hour := t.Truncate(time.Hour)
+	var samples []hourSample
+	for _, s := range b.Hours {
+		d := hour.Sub(time.Unix(s.Hour, 0))
+		if d > 0 && d%(7*24*time.Hour) == 0 && d <= time.Duration(weeks)*7*24*time.Hour {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// record adds the result of the window ending at t, and drops samples older than weeks
+func (b *baseline) record(t time.Time, count int, minutes float64, weeks int) {
+	hour := t.Truncate(time.Hour).Unix()
+	if n := len(b.Hours); n > 0 && b.Hours[n-1].Hour == hour {
+		b.Hours[n-1].Count += count
+		b.Hours[n-1].Minutes += minutes
+	} else {
+		b.Hours = append(b.Hours, hourSample{Hour: hour, Count: count, Minutes: minutes})
+	}
+	oldest := t.Truncate(time.Hour).Add(-time.Duration(weeks) * 7 * 24 * time.Hour).Unix()
+	i := 0
+	for i < len(b.Hours) && b.Hours[i].Hour < oldest {
+		i++
+	}
+	b.Hours = b.Hours[i:]
+}
+
+func meanStddev(samples []hourSample) (float64, float64) {
+	var sum float64
+	for _, s := range samples {
+		sum += s.rate()
+	}
+	mean := sum / float64(len(samples))
+	var sq float64
+	for _, s := range samples {
+		sq += (s.rate() - mean) * (s.rate() - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(samples)))
+}
+
+// anomaly compares the rate of the window with the baseline, and returns the status and the note to show.
+// Until enough samples are collected, it returns OK with a note of the warm-up.
+// The allowed increase over the mean is at least --anomaly-min-increase, so that a constant or all-zero baseline
+// doesn't report a few matches as an anomaly.
+func (p *awsCWLogsInsightsPlugin) anomaly(b *baseline, res *ParsedQueryResults) (checkers.Status, string) {
+	samples := b.samplesAt(res.EndTime, p.AnomalyWeeks)
+	if len(samples) < p.AnomalyMinSamples {
+		return checkers.OK, fmt.Sprintf("baseline warming up: %d/%d samples", len(samples), p.AnomalyMinSamples)
+	}
+	mean, sd := meanStddev(samples)
+	increase := p.AnomalyStddev * sd
+	if p.AnomalyPercent > 0 {
+		increase = mean * p.AnomalyPercent / 100
+	}
+	threshold := mean + math.Max(increase, p.AnomalyMinIncrease)
+	rate := float64(res.MatchedCount) / windowMinutes(res)
+	if rate <= threshold {
+		return checkers.OK, ""
+	}
+	status := checkers.WARNING
+	if p.AnomalyStatus == "critical" {
+		status = checkers.CRITICAL
+	}
+	return status, fmt.Sprintf("%.1f/min > %.1f/min, baseline %.1f±%.1f/min", rate, threshold, mean, sd)
+}
+
+// windowMinutes returns the length of the searched window in minutes
+func windowMinutes(res *ParsedQueryResults) float64 {
+	m := res.EndTime.Sub(res.StartTime).Minutes()
+	if m <= 0 {
+		return 1
+	}
+	return m
+}
+
+// evaluateAnomaly applies the anomaly mode to the status by the thresholds, and records the result in the baseline.
+// The worse of the two statuses is returned.
+func (p *awsCWLogsInsightsPlugin) evaluateAnomaly(status checkers.Status, summary string, res *ParsedQueryResults) (checkers.Status, string) {
+	b, err := p.loadBaseline()
+	if err != nil {
+		logger.Warningf("ignoring the broken baseline: %v", err)
+		b = &baseline{}
+	}
+	anomalyStatus, note := p.anomaly(b, res)
+	if anomalyStatus > status {
+		status = anomalyStatus
+	}
+	if note != "" {
+		summary += " (" + note + ")"
+	}
+	b.record(res.EndTime, res.MatchedCount, windowMinutes(res), p.AnomalyWeeks)
+	if err := p.saveBaseline(b); err != nil {
+		logger.Warningf("failed to save the baseline: %v", err)
+	}
+	return status, summary
+}
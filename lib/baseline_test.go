@@ -0,0 +1,219 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+// syntheticBaseline returns a baseline with a sample of the rate per minute for the hour of end in each past week
+func syntheticBaseline(end time.Time, rates ...float64) *baseline {
+	b := &baseline{}
+	hour := end.Truncate(time.Hour)
+	for i := len(rates) - 1; i >= 0; i-- {
+		week := hour.Add(-time.Duration(i+1) * 7 * 24 * time.Hour)
+		b.Hours = append(b.Hours, hourSample{Hour: week.Unix(), Count: int(rates[i] * 60), Minutes: 60})
+		// samples of other hours are not used
+		b.Hours = append(b.Hours, hourSample{Hour: week.Add(time.Hour).Unix(), Count: 6000, Minutes: 60})
+	}
+	return b
+}
+
+func Test_awsCWLogsInsightsPlugin_anomaly(t *testing.T) {
+	end := time.Date(2020, 10, 12, 3, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		opts     *logOpts
+		baseline *baseline
+		count    int
+		want     checkers.Status
+		wantNote string
+	}{
+		{
+			name:     "no history",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyWeeks: 4, AnomalyMinSamples: 3},
+			baseline: &baseline{},
+			count:    100,
+			want:     checkers.OK,
+			wantNote: "baseline warming up: 0/3 samples",
+		},
+		{
+			name:     "warming up",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyWeeks: 4, AnomalyMinSamples: 3},
+			baseline: syntheticBaseline(end, 2, 4),
+			count:    100,
+			want:     checkers.OK,
+			wantNote: "baseline warming up: 2/3 samples",
+		},
+		{
+			name:     "within stddev",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyWeeks: 4, AnomalyMinSamples: 3},
+			baseline: syntheticBaseline(end, 2, 4, 2, 4),
+			count:    6,
+			want:     checkers.OK,
+		},
+		{
+			name:     "over stddev",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyWeeks: 4, AnomalyMinSamples: 3, AnomalyStatus: "critical"},
+			baseline: syntheticBaseline(end, 2, 4, 2, 4),
+			count:    7,
+			want:     checkers.CRITICAL,
+			wantNote: "7.0/min > 6.0/min, baseline 3.0±1.0/min",
+		},
+		{
+			name:     "samples older than weeks are not used",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyWeeks: 2, AnomalyMinSamples: 2, AnomalyStatus: "warning"},
+			baseline: syntheticBaseline(end, 3, 3, 100, 100),
+			count:    4,
+			want:     checkers.WARNING,
+			wantNote: "4.0/min > 3.0/min, baseline 3.0±0.0/min",
+		},
+		{
+			name:     "within percent",
+			opts:     &logOpts{AnomalyPercent: 50, AnomalyWeeks: 4, AnomalyMinSamples: 3},
+			baseline: syntheticBaseline(end, 2, 4, 2, 4),
+			count:    4,
+			want:     checkers.OK,
+		},
+		{
+			name:     "over percent",
+			opts:     &logOpts{AnomalyPercent: 50, AnomalyWeeks: 4, AnomalyMinSamples: 3, AnomalyStatus: "warning"},
+			baseline: syntheticBaseline(end, 2, 4, 2, 4),
+			count:    5,
+			want:     checkers.WARNING,
+			wantNote: "5.0/min > 4.5/min, baseline 3.0±1.0/min",
+		},
+		{
+			name:     "a match over an all-zero history",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyMinIncrease: 1, AnomalyWeeks: 4, AnomalyMinSamples: 3},
+			baseline: syntheticBaseline(end, 0, 0, 0),
+			count:    1,
+			want:     checkers.OK,
+		},
+		{
+			name:     "over an all-zero history",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyMinIncrease: 1, AnomalyWeeks: 4, AnomalyMinSamples: 3, AnomalyStatus: "warning"},
+			baseline: syntheticBaseline(end, 0, 0, 0),
+			count:    2,
+			want:     checkers.WARNING,
+			wantNote: "2.0/min > 1.0/min, baseline 0.0±0.0/min",
+		},
+		{
+			name:     "percent over an all-zero history",
+			opts:     &logOpts{AnomalyPercent: 50, AnomalyMinIncrease: 1, AnomalyWeeks: 4, AnomalyMinSamples: 3},
+			baseline: syntheticBaseline(end, 0, 0, 0),
+			count:    1,
+			want:     checkers.OK,
+		},
+		{
+			name:     "within the min increase over a constant history",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyMinIncrease: 1, AnomalyWeeks: 4, AnomalyMinSamples: 3},
+			baseline: syntheticBaseline(end, 3, 3, 3),
+			count:    4,
+			want:     checkers.OK,
+		},
+		{
+			name:     "over the min increase over a constant history",
+			opts:     &logOpts{AnomalyStddev: 3, AnomalyMinIncrease: 1, AnomalyWeeks: 4, AnomalyMinSamples: 3, AnomalyStatus: "warning"},
+			baseline: syntheticBaseline(end, 3, 3, 3),
+			count:    5,
+			want:     checkers.WARNING,
+			wantNote: "5.0/min > 4.0/min, baseline 3.0±0.0/min",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsCWLogsInsightsPlugin{logOpts: tt.opts}
+			res := &ParsedQueryResults{MatchedCount: tt.count, StartTime: end.Add(-time.Minute), EndTime: end}
+			got, note := p.anomaly(tt.baseline, res)
+			if got != tt.want || note != tt.wantNote {
+				t.Errorf("awsCWLogsInsightsPlugin.anomaly() = %v, %q, want %v, %q", got, note, tt.want, tt.wantNote)
+			}
+		})
+	}
+}
+
+func Test_baseline_record(t *testing.T) {
+	end := time.Date(2020, 10, 12, 3, 59, 0, 0, time.UTC)
+	b := syntheticBaseline(end, 1, 1, 1)
+	b.record(end, 5, 1, 2)
+	b.record(end.Add(time.Minute), 3, 2, 2)
+	b.record(end.Add(2*time.Minute), 4, 1, 2)
+
+	hour := end.Truncate(time.Hour)
+	oldest := hour.Add(-2 * 7 * 24 * time.Hour).Unix()
+	for _, s := range b.Hours {
+		if s.Hour < oldest {
+			t.Errorf("sample %+v is older than 2 weeks", s)
+		}
+	}
+	n := len(b.Hours)
+	want := []hourSample{
+		{Hour: hour.Unix(), Count: 5, Minutes: 1},
+		{Hour: hour.Add(time.Hour).Unix(), Count: 7, Minutes: 3},
+	}
+	if n < 2 || b.Hours[n-2] != want[0] || b.Hours[n-1] != want[1] {
+		t.Errorf("baseline.record() Hours = %+v, want %+v at the end", b.Hours, want)
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_evaluateAnomaly(t *testing.T) {
+	end := time.Date(2020, 10, 12, 3, 30, 0, 0, time.UTC)
+	p := &awsCWLogsInsightsPlugin{
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+		logOpts:   &logOpts{WarningOver: 100, CriticalOver: 100, AnomalyStddev: 2, AnomalyStatus: "warning", AnomalyWeeks: 4, AnomalyMinSamples: 2},
+	}
+	if err := p.saveBaseline(syntheticBaseline(end, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	res := &ParsedQueryResults{Finished: true, MatchedCount: 3, StartTime: end.Add(-time.Minute), EndTime: end}
+	ckr := p.evaluateWithHistory(res, nil)
+	if want := "3 messages (3.0/min > 1.0/min, baseline 1.0±0.0/min)"; ckr.Status != checkers.WARNING || ckr.Message != want {
+		t.Errorf("evaluateWithHistory() = %v %q, want %v %q", ckr.Status, ckr.Message, checkers.WARNING, want)
+	}
+	// the static thresholds still apply
+	res = &ParsedQueryResults{Finished: true, MatchedCount: 101, StartTime: end, EndTime: end.Add(time.Minute)}
+	if ckr := p.evaluateWithHistory(res, nil); ckr.Status != checkers.CRITICAL {
+		t.Errorf("evaluateWithHistory() = %v %q, want %v", ckr.Status, ckr.Message, checkers.CRITICAL)
+	}
+
+	b, err := p.loadBaseline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := b.Hours[len(b.Hours)-1]
+	if want := (hourSample{Hour: end.Truncate(time.Hour).Unix(), Count: 104, Minutes: 2}); last != want {
+		t.Errorf("last sample = %+v, want %+v", last, want)
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_evaluateAnomaly_withStateStore(t *testing.T) {
+	end := time.Date(2020, 10, 12, 3, 30, 0, 0, time.UTC)
+	store := newMemoryStateStore(fileStateStore{})
+	p := &awsCWLogsInsightsPlugin{
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+		logOpts:   &logOpts{WarningOver: 100, CriticalOver: 100, AnomalyStddev: 2, AnomalyStatus: "warning", AnomalyWeeks: 4, AnomalyMinSamples: 2},
+		store:     store,
+	}
+	res := &ParsedQueryResults{Finished: true, MatchedCount: 3, StartTime: end.Add(-time.Minute), EndTime: end}
+	p.evaluateWithHistory(res, nil)
+
+	// the baseline is kept in memory until flush, as the state is
+	if _, err := os.Stat(p.baselineFile()); !os.IsNotExist(err) {
+		t.Errorf("baseline file is written before flush: %v", err)
+	}
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+	var b baseline
+	if err := loadJSON(fileStateStore{}, p.baselineFile(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := []hourSample{{Hour: end.Truncate(time.Hour).Unix(), Count: 3, Minutes: 1}}; !reflect.DeepEqual(b.Hours, want) {
+		t.Errorf("flushed baseline = %+v, want %+v", b.Hours, want)
+	}
+}
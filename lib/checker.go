@@ -0,0 +1,167 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mackerelio/checkers"
+)
+
+// Options are the options of a check. The fields are the common command-line options of the plugin,
+// and Args takes any other command-line options, e.g. []string{"--anomaly-stddev=3"}.
+// The fields are stable, but Args are not: they follow the command-line options of the plugin,
+// which may change between versions.
+type Options struct {
+	// LogGroupNames are the log groups to search. It is required unless the query language is sql.
+	LogGroupNames []string
+	// QueryLanguage is cwli (default), ppl or sql
+	QueryLanguage string
+	// Filter is the query. It is required unless QueryDefinition or --filter-file in Args is given.
+	Filter string
+	// QueryDefinition is the name or the ID of the saved query to use instead of Filter
+	QueryDefinition string
+
+	WarningOver  int
+	CriticalOver int
+	// ReturnMessage adds matched log messages to the message of non-OK results
+	ReturnMessage bool
+
+	// StateDir keeps the state files. It is the work dir of mackerel-agent plugins by default.
+	StateDir string
+	// Timeout stops the query if it does not finish within it. 0 means no timeout.
+	Timeout time.Duration
+
+	// Args are other command-line options of the plugin. They are outside the stability guarantee of this API.
+	Args []string
+}
+
+// args returns the command-line arguments of the plugin for opts
+func (opts *Options) args() []string {
+	var args []string
+	for _, g := range opts.LogGroupNames {
+		args = append(args, "--log-group-name="+g)
+	}
+	if opts.QueryLanguage != "" {
+		args = append(args, "--query-language="+opts.QueryLanguage)
+	}
+	if opts.Filter != "" {
+		args = append(args, "--filter="+opts.Filter)
+	}
+	if opts.QueryDefinition != "" {
+		args = append(args, "--query-definition="+opts.QueryDefinition)
+	}
+	if opts.WarningOver != 0 {
+		args = append(args, "--warning-over="+strconv.Itoa(opts.WarningOver))
+	}
+	if opts.CriticalOver != 0 {
+		args = append(args, "--critical-over="+strconv.Itoa(opts.CriticalOver))
+	}
+	if opts.ReturnMessage {
+		args = append(args, "--return")
+	}
+	if opts.StateDir != "" {
+		args = append(args, "--state-dir="+opts.StateDir)
+	}
+	if opts.Timeout != 0 {
+		args = append(args, "--timeout="+opts.Timeout.String())
+	}
+	return append(args, opts.Args...)
+}
+
+// checkerConfig is set by Option
+type checkerConfig struct {
+	newClient clientFunc
+	identity  []string
+	store     stateStore
+}
+
+// Option configures Checker
+type Option func(*checkerConfig)
+
+// WithClient makes Checker use client in region instead of the client created from the AWS config.
+// The options for the client, such as --endpoint-url, are ignored.
+// identity names the account or the credentials of client, e.g. the account ID. Checkers with the same Options
+// keep separate states when their regions or identities differ.
+func WithClient(client Client, region, identity string) Option {
+	return func(cfg *checkerConfig) {
+		cfg.newClient = func(context.Context, *logOpts) (Client, string, error) {
+			return client, region, nil
+		}
+		cfg.identity = []string{identity, region}
+	}
+}
+
+// WithStateStore makes Checker keep the states, including the baseline of --anomaly-*, in store instead of the state files.
+// The cache of --query-definition and the slots of --max-concurrent-queries are still kept in the state dir.
+func WithStateStore(store StateStore) Option {
+	return func(cfg *checkerConfig) {
+		cfg.store = publicStateStore{store}
+	}
+}
+
+// Checker runs a check of CloudWatch Logs Insights as the plugin does.
+// Each Run searches the window after the one searched by the last Run.
+type Checker struct {
+	plugin *awsCWLogsInsightsPlugin
+}
+
+// Result is the result of a run of Checker
+type Result struct {
+	Status  checkers.Status
+	Message string
+	// Query is the result of the query, or nil when the query failed.
+	// It is partial when the query did not finish within the timeout.
+	Query *ParsedQueryResults
+}
+
+// NewChecker creates Checker for opts. It returns *Error when opts are invalid or the client is not available.
+func NewChecker(ctx context.Context, opts Options, options ...Option) (*Checker, error) {
+	cfg := &checkerConfig{newClient: newClient}
+	for _, o := range options {
+		o(cfg)
+	}
+	args := opts.args()
+	lo := &logOpts{}
+	if _, err := flags.NewParser(lo, flags.PassDoubleDash).ParseArgs(args); err != nil {
+		return nil, withClass(ErrorClassInvalid, fmt.Errorf("invalid options: %w", err))
+	}
+	c, err := newChecker(ctx, lo, args, cfg)
+	if err != nil {
+		return nil, asError(err)
+	}
+	return c, nil
+}
+
+func newChecker(ctx context.Context, opts *logOpts, args []string, cfg *checkerConfig) (*Checker, error) {
+	p, err := newCWLogsInsightsPluginWithClient(ctx, opts, args, cfg.newClient, cfg.identity)
+	if err != nil {
+		return nil, err
+	}
+	p.store = cfg.store
+	return &Checker{plugin: p}, nil
+}
+
+// Run searches the logs, and evaluates the result.
+// When the check fails, it returns *Error with the Result reporting the error by --on-error.
+// Run is not safe for concurrent use.
+func (c *Checker) Run(ctx context.Context) (*Result, error) {
+	r := c.run(ctx)
+	return &Result{Status: r.Status, Message: r.Message, Query: r.res}, asError(r.err)
+}
+
+func (c *Checker) run(ctx context.Context) *checkResult {
+	if c.plugin.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.plugin.Timeout)
+		defer cancel()
+	}
+	opts, err := c.plugin.reloadQueryDefinition(ctx, time.Now())
+	if err != nil {
+		return &checkResult{Checker: c.plugin.errorChecker(err, c.plugin.lastStatus), opts: c.plugin.logOpts, err: err}
+	}
+	c.plugin.logOpts = opts
+	return c.plugin.run(ctx)
+}
@@ -0,0 +1,143 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/mackerelio/checkers"
+	"github.com/stretchr/testify/mock"
+)
+
+// mapStateStore is StateStore in a map
+type mapStateStore map[string][]byte
+
+func (m mapStateStore) Load(key string) ([]byte, error) {
+	b, ok := m[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return b, nil
+}
+
+func (m mapStateStore) Save(key string, data []byte) error {
+	m[key] = data
+	return nil
+}
+
+func Test_Options_args(t *testing.T) {
+	opts := Options{
+		LogGroupNames: []string{"/log/foo", "/log/bar"},
+		Filter:        "filter @message like /omg/",
+		WarningOver:   1,
+		CriticalOver:  5,
+		ReturnMessage: true,
+		StateDir:      "/tmp/state",
+		Timeout:       25 * time.Second,
+		Args:          []string{"--anomaly-stddev=3"},
+	}
+	want := []string{
+		"--log-group-name=/log/foo", "--log-group-name=/log/bar", "--filter=filter @message like /omg/",
+		"--warning-over=1", "--critical-over=5", "--return", "--state-dir=/tmp/state", "--timeout=25s", "--anomaly-stddev=3",
+	}
+	if got := opts.args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("args() = %q, want %q", got, want)
+	}
+}
+
+func Test_Checker_Run(t *testing.T) {
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+		QueryId: aws.String("DUMMY-QUERY-ID"),
+	}, nil)
+	svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+		Status:     types.QueryStatusComplete,
+		Statistics: &types.QueryStatistics{RecordsMatched: 3},
+	}, nil).Once()
+	svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+		Status: types.QueryStatusFailed,
+	}, nil)
+	store := mapStateStore{}
+	opts := Options{
+		LogGroupNames: []string{"/log/foo"},
+		Filter:        "filter @message like /omg/",
+		WarningOver:   1,
+		CriticalOver:  5,
+		StateDir:      t.TempDir(),
+	}
+	c, err := NewChecker(context.Background(), opts, WithClient(svc, "ap-northeast-1", "123456789012"), WithStateStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != checkers.WARNING || res.Message != "3 > 1 messages" || res.Query == nil || res.Query.MatchedCount != 3 {
+		t.Errorf("Run() = %+v", res)
+	}
+	if _, ok := store[storeKey(c.plugin.StateFile)]; len(store) != 1 || !ok || strings.Contains(storeKey(c.plugin.StateFile), "/") {
+		t.Errorf("states = %v, want the state of the check by its hash", store)
+	}
+
+	// failures are returned as *Error with the result by --on-error
+	res, err = c.Run(context.Background())
+	var e *Error
+	if !errors.As(err, &e) || e.Class != ErrorClassQuery {
+		t.Fatalf("Run() error = %#v, want *Error of %s", err, ErrorClassQuery)
+	}
+	if res.Status != checkers.UNKNOWN || res.Query != nil {
+		t.Errorf("Run() = %+v", res)
+	}
+}
+
+func Test_NewChecker_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "unknown option", opts: Options{LogGroupNames: []string{"/log/foo"}, Filter: "filter @message like /omg/", Args: []string{"--unknown"}}},
+		{name: "no query", opts: Options{LogGroupNames: []string{"/log/foo"}}},
+		{name: "bad language", opts: Options{LogGroupNames: []string{"/log/foo"}, Filter: "filter @message like /omg/", QueryLanguage: "cobol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewChecker(context.Background(), tt.opts, WithClient(&mockAWSCloudWatchLogsClient{}, "ap-northeast-1", "123456789012"))
+			var e *Error
+			if !errors.As(err, &e) || e.Class != ErrorClassInvalid {
+				t.Errorf("NewChecker() error = %#v, want *Error of %s", err, ErrorClassInvalid)
+			}
+		})
+	}
+}
+
+func Test_NewChecker_stateKey(t *testing.T) {
+	opts := Options{LogGroupNames: []string{"/log/foo"}, Filter: "filter @message like /omg/", StateDir: t.TempDir()}
+	key := func(region, identity string) string {
+		t.Helper()
+		c, err := NewChecker(context.Background(), opts, WithClient(&mockAWSCloudWatchLogsClient{}, region, identity))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storeKey(c.plugin.StateFile)
+	}
+
+	tokyo := key("ap-northeast-1", "123456789012")
+	if got := key("ap-northeast-1", "123456789012"); got != tokyo {
+		t.Errorf("state key = %q, want %q for the same client", got, tokyo)
+	}
+	if got := key("us-east-1", "123456789012"); got == tokyo {
+		t.Errorf("state key = %q for another region", got)
+	}
+	if got := key("ap-northeast-1", "210987654321"); got == tokyo {
+		t.Errorf("state key = %q for another identity", got)
+	}
+}
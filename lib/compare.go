@@ -0,0 +1,101 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+// comparison is the result of the query over the window shifted by --compare-offset
+type comparison struct {
+	Offset time.Duration
+	// PastCount is the matched count in the shifted window
+	PastCount int
+	// Err is set when the query over the shifted window failed
+	Err error
+}
+
+// ratio returns the ratio of count to the past count.
+// The past count of 0 is taken as 1, so that a few messages after a quiet window are not an infinite ratio.
+func (c *comparison) ratio(count int) float64 {
+	past := c.PastCount
+	if past < 1 {
+		past = 1
+	}
+	return float64(count) / float64(past)
+}
+
+// validateComparison checks options of the comparison mode
+func (opts *logOpts) validateComparison() error {
+	if opts.CompareOffset < 0 {
+		return errors.New("--compare-offset must be positive")
+	}
+	if opts.CompareWarningRatio < 0 || opts.CompareCriticalRatio < 0 {
+		return errors.New("--compare-warning-ratio and --compare-critical-ratio must be positive")
+	}
+	hasRatio := opts.CompareWarningRatio > 0 || opts.CompareCriticalRatio > 0
+	if opts.CompareOffset > 0 && !hasRatio {
+		return errors.New("--compare-offset requires --compare-warning-ratio or --compare-critical-ratio")
+	}
+	if opts.CompareOffset == 0 && hasRatio {
+		return errors.New("--compare-warning-ratio and --compare-critical-ratio require --compare-offset")
+	}
+	return nil
+}
+
+// compare runs the query over the window of res shifted by --compare-offset.
+// It returns nil when the comparison mode is disabled.
+func (p *awsCWLogsInsightsPlugin) compare(ctx context.Context, res *ParsedQueryResults, poll *pollStrategy) *comparison {
+	if p.CompareOffset <= 0 {
+		return nil
+	}
+	c := &comparison{Offset: p.CompareOffset}
+	past, err := p.query(ctx, res.StartTime.Add(-p.CompareOffset), res.EndTime.Add(-p.CompareOffset), poll, nil)
+	if err != nil {
+		logger.Warningf("failed to query the window %s ago: %v", formatOffset(p.CompareOffset), err)
+		c.Err = err
+		return c
+	}
+	c.PastCount = past.MatchedCount
+	return c
+}
+
+// applyComparison applies the ratio thresholds to the status by the thresholds.
+// The worse of the two statuses is returned. When the past window could not be searched,
+// only the thresholds are applied.
+func (p *awsCWLogsInsightsPlugin) applyComparison(status checkers.Status, summary string, res *ParsedQueryResults, c *comparison) (checkers.Status, string) {
+	ago := formatOffset(c.Offset)
+	if c.Err != nil {
+		return status, summary + fmt.Sprintf(" (failed to compare with %s ago: %v)", ago, c.Err)
+	}
+	ratio := c.ratio(res.MatchedCount)
+	cmpStatus := checkers.OK
+	note := fmt.Sprintf("%.1fx of %d messages %s ago", ratio, c.PastCount, ago)
+	if p.CompareCriticalRatio > 0 && ratio > p.CompareCriticalRatio {
+		cmpStatus = checkers.CRITICAL
+		note = fmt.Sprintf("%.1fx > %.1fx of %d messages %s ago", ratio, p.CompareCriticalRatio, c.PastCount, ago)
+	} else if p.CompareWarningRatio > 0 && ratio > p.CompareWarningRatio {
+		cmpStatus = checkers.WARNING
+		note = fmt.Sprintf("%.1fx > %.1fx of %d messages %s ago", ratio, p.CompareWarningRatio, c.PastCount, ago)
+	}
+	if cmpStatus > status {
+		status = cmpStatus
+	}
+	return status, summary + " (" + note + ")"
+}
+
+// formatOffset formats d without trailing zero units, e.g. 24h instead of 24h0m0s
+func formatOffset(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,134 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+func Test_awsCWLogsInsightsPlugin_applyComparison(t *testing.T) {
+	opts := &logOpts{WarningOver: 100, CriticalOver: 100, CompareOffset: 24 * time.Hour, CompareWarningRatio: 2, CompareCriticalRatio: 5}
+	tests := []struct {
+		name        string
+		count       int
+		cmp         *comparison
+		want        checkers.Status
+		wantSummary string
+	}{
+		{
+			name:        "within ratio",
+			count:       8,
+			cmp:         &comparison{Offset: 24 * time.Hour, PastCount: 4},
+			want:        checkers.OK,
+			wantSummary: "8 messages (2.0x of 4 messages 24h ago)",
+		},
+		{
+			name:        "over warning ratio",
+			count:       9,
+			cmp:         &comparison{Offset: 24 * time.Hour, PastCount: 4},
+			want:        checkers.WARNING,
+			wantSummary: "9 messages (2.2x > 2.0x of 4 messages 24h ago)",
+		},
+		{
+			name:        "over critical ratio",
+			count:       30,
+			cmp:         &comparison{Offset: 24 * time.Hour, PastCount: 5},
+			want:        checkers.CRITICAL,
+			wantSummary: "30 messages (6.0x > 5.0x of 5 messages 24h ago)",
+		},
+		{
+			name:        "past count is zero",
+			count:       2,
+			cmp:         &comparison{Offset: 24 * time.Hour},
+			want:        checkers.OK,
+			wantSummary: "2 messages (2.0x of 0 messages 24h ago)",
+		},
+		{
+			name:        "past and current counts are zero",
+			count:       0,
+			cmp:         &comparison{Offset: 24 * time.Hour},
+			want:        checkers.OK,
+			wantSummary: "0 messages (0.0x of 0 messages 24h ago)",
+		},
+		{
+			name:        "thresholds are worse",
+			count:       101,
+			cmp:         &comparison{Offset: 24 * time.Hour, PastCount: 100},
+			want:        checkers.CRITICAL,
+			wantSummary: "101 > 100 messages (1.0x of 100 messages 24h ago)",
+		},
+		{
+			name:        "failed to query the past window",
+			count:       30,
+			cmp:         &comparison{Offset: 168 * time.Hour, Err: errors.New("query was finished with `Failed` status")},
+			want:        checkers.OK,
+			wantSummary: "30 messages (failed to compare with 168h ago: query was finished with `Failed` status)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsCWLogsInsightsPlugin{logOpts: opts}
+			res := &ParsedQueryResults{Finished: true, MatchedCount: tt.count}
+			status, summary := p.evaluate(res)
+			got, gotSummary := p.applyComparison(status, summary, res, tt.cmp)
+			if got != tt.want || gotSummary != tt.wantSummary {
+				t.Errorf("awsCWLogsInsightsPlugin.applyComparison() = %v, %q, want %v, %q", got, gotSummary, tt.want, tt.wantSummary)
+			}
+		})
+	}
+}
+
+func Test_logOpts_validateComparison(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *logOpts
+		wantErr string
+	}{
+		{
+			name: "disabled",
+			opts: &logOpts{},
+		},
+		{
+			name: "offset and ratio",
+			opts: &logOpts{CompareOffset: time.Hour, CompareCriticalRatio: 3},
+		},
+		{
+			name:    "offset without ratio",
+			opts:    &logOpts{CompareOffset: time.Hour},
+			wantErr: "--compare-offset requires --compare-warning-ratio or --compare-critical-ratio",
+		},
+		{
+			name:    "ratio without offset",
+			opts:    &logOpts{CompareWarningRatio: 2},
+			wantErr: "--compare-warning-ratio and --compare-critical-ratio require --compare-offset",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.validateComparison()
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("logOpts.validateComparison() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_formatOffset(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{24 * time.Hour, "24h"},
+		{90 * time.Minute, "1h30m"},
+		{10 * time.Minute, "10m"},
+		{45 * time.Second, "45s"},
+		{time.Hour + 30*time.Second, "1h0m30s"},
+	}
+	for _, tt := range tests {
+		if got := formatOffset(tt.d); got != tt.want {
+			t.Errorf("formatOffset(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
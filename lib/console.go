@@ -0,0 +1,63 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// consoleURL returns a URL of CloudWatch Logs Insights console which runs the query on the window
+func consoleURL(region string, logGroupNames []string, query string, startTime, endTime time.Time) string {
+	// The console keeps the query in the fragment, encoded in JSURL (https://github.com/Sage/jsurl)
+	// and then escaped by encodeURIComponent with '%' replaced by '$'.
+	var b strings.Builder
+	b.WriteString("~(end~'")
+	b.WriteString(jsurlEscape(endTime.UTC().Format(consoleTimeFormat)))
+	b.WriteString("~start~'")
+	b.WriteString(jsurlEscape(startTime.UTC().Format(consoleTimeFormat)))
+	b.WriteString("~timeType~'ABSOLUTE~tz~'UTC~editorString~'")
+	b.WriteString(jsurlEscape(query))
+	b.WriteString("~source~(")
+	for _, name := range logGroupNames {
+		b.WriteString("~'")
+		b.WriteString(jsurlEscape(name))
+	}
+	b.WriteString("))")
+
+	return fmt.Sprintf("%s/cloudwatch/home?region=%s#logsV2:logs-insights$3FqueryDetail$3D%s",
+		consoleEndpoint(region), region, b.String())
+}
+
+const consoleTimeFormat = "2006-01-02T15:04:05.000Z"
+
+func consoleEndpoint(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return fmt.Sprintf("https://%s.console.amazonaws.cn", region)
+	case strings.HasPrefix(region, "us-gov-"):
+		return "https://console.amazonaws-us-gov.com"
+	default:
+		return fmt.Sprintf("https://%s.console.aws.amazon.com", region)
+	}
+}
+
+// jsurlEscape escapes a string value of JSURL.
+// Characters other than [A-Za-z0-9_.-] are escaped as *XX, or **XXXX for UTF-16 code units beyond 0xff,
+// and '$' is escaped as '!'.
+func jsurlEscape(s string) string {
+	var b strings.Builder
+	for _, c := range utf16.Encode([]rune(s)) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_', c == '-', c == '.':
+			b.WriteRune(rune(c))
+		case c == '$':
+			b.WriteByte('!')
+		case c < 0x100:
+			fmt.Fprintf(&b, "*%02x", c)
+		default:
+			fmt.Fprintf(&b, "**%04x", c)
+		}
+	}
+	return b.String()
+}
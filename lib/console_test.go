@@ -0,0 +1,54 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_consoleURL(t *testing.T) {
+	got := consoleURL(
+		"ap-northeast-1",
+		[]string{"/aws/lambda/foo", "/aws/lambda/bar"},
+		"filter @message like /error/ | fields @message",
+		time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC),
+		time.Date(2020, 10, 12, 12, 1, 0, 0, time.FixedZone("JST", 9*60*60)),
+	)
+	want := "https://ap-northeast-1.console.aws.amazon.com/cloudwatch/home?region=ap-northeast-1#logsV2:logs-insights$3FqueryDetail$3D" +
+		"~(end~'2020-10-12T03*3a01*3a00.000Z~start~'2020-10-12T03*3a00*3a00.000Z~timeType~'ABSOLUTE~tz~'UTC" +
+		"~editorString~'filter*20*40message*20like*20*2ferror*2f*20*7c*20fields*20*40message" +
+		"~source~(~'*2faws*2flambda*2ffoo~'*2faws*2flambda*2fbar))"
+	if got != want {
+		t.Errorf("consoleURL() = %s, want %s", got, want)
+	}
+}
+
+func Test_consoleEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"us-east-1":     "https://us-east-1.console.aws.amazon.com",
+		"cn-north-1":    "https://cn-north-1.console.amazonaws.cn",
+		"us-gov-west-1": "https://console.amazonaws-us-gov.com",
+	}
+	for region, want := range tests {
+		if got := consoleEndpoint(region); got != want {
+			t.Errorf("consoleEndpoint(%q) = %s, want %s", region, got, want)
+		}
+	}
+}
+
+func Test_jsurlEscape(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "app_log-group.1", want: "app_log-group.1"},
+		{s: "stats count(*) by bin(5m)", want: "stats*20count*28*2a*29*20by*20bin*285m*29"},
+		{s: "fields $price, 'quoted' ~", want: "fields*20!price*2c*20*27quoted*27*20*7e"},
+		{s: "エラー", want: "**30a8**30e9**30fc"},
+		{s: "🔥", want: "**d83d**dd25"},
+	}
+	for _, tt := range tests {
+		if got := jsurlEscape(tt.s); got != tt.want {
+			t.Errorf("jsurlEscape(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mackerelio/checkers"
+	"github.com/mackerelio/golib/logging"
+)
+
+const (
+	defaultCheckInterval           = time.Minute
+	defaultSaveInterval            = time.Minute
+	defaultDaemonConcurrentQueries = 10
+)
+
+// serveOpts are options of the serve subcommand
+type serveOpts struct {
+	Config string `long:"config" value-name:"FILE" required:"true" description:"Config file of the checks to run" unquote:"false"`
+	Listen string `long:"listen" value-name:"ADDR" default:"127.0.0.1:8931" description:"Address to serve the latest results of the checks"`
+	Debug  bool   `long:"debug" description:"Enable debug log"`
+}
+
+// daemonConfig is the config file of the serve subcommand
+type daemonConfig struct {
+	// MaxConcurrentQueries limits queries running at once over all checks
+	MaxConcurrentQueries int `json:"max_concurrent_queries"`
+	// SaveInterval is the interval to write states to the state files
+	SaveInterval duration      `json:"save_interval"`
+	Checks       []checkConfig `json:"checks"`
+}
+
+// checkConfig is a check run by the daemon
+type checkConfig struct {
+	Name     string   `json:"name"`
+	Interval duration `json:"interval"`
+	// Args are the options of the check, as given to the plugin
+	Args []string `json:"args"`
+}
+
+// duration is time.Duration written as a string like "1m" in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// loadDaemonConfig reads the config file, and fills the defaults
+func loadDaemonConfig(file string) (*daemonConfig, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	cfg := &daemonConfig{}
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+	if cfg.MaxConcurrentQueries == 0 {
+		cfg.MaxConcurrentQueries = defaultDaemonConcurrentQueries
+	}
+	if cfg.SaveInterval == 0 {
+		cfg.SaveInterval = duration(defaultSaveInterval)
+	}
+	if cfg.MaxConcurrentQueries < 0 || cfg.SaveInterval < 0 {
+		return nil, errors.New("max_concurrent_queries and save_interval must be positive")
+	}
+	names := map[string]bool{}
+	for i := range cfg.Checks {
+		c := &cfg.Checks[i]
+		if c.Name == "" {
+			return nil, fmt.Errorf("checks[%d]: name is required", i)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("check %q: duplicate name", c.Name)
+		}
+		names[c.Name] = true
+		if c.Interval == 0 {
+			c.Interval = duration(defaultCheckInterval)
+		}
+		if c.Interval < 0 {
+			return nil, fmt.Errorf("check %q: interval must be positive", c.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// parseCheckArgs parses the options of the check.
+// The timeout of the check is the interval unless --timeout is given.
+func (c *checkConfig) parseCheckArgs() (*logOpts, error) {
+	opts := &logOpts{}
+	if _, err := flags.NewParser(opts, flags.PassDoubleDash).ParseArgs(c.Args); err != nil {
+		return nil, err
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Duration(c.Interval)
+	}
+	return opts, nil
+}
+
+// clientCache shares clients among checks with the same AWS settings
+type clientCache struct {
+	newClient clientFunc
+
+	mu      sync.Mutex
+	clients map[string]cachedClient
+}
+
+type cachedClient struct {
+	client Client
+	region string
+}
+
+func newClientCache(newClient clientFunc) *clientCache {
+	return &clientCache{newClient: newClient, clients: map[string]cachedClient{}}
+}
+
+func (c *clientCache) get(ctx context.Context, opts *logOpts) (Client, string, error) {
+	key := strings.Join([]string{opts.EndpointURL, strconv.FormatBool(opts.NoVerifySSL), opts.CABundle}, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cc, ok := c.clients[key]; ok {
+		return cc.client, cc.region, nil
+	}
+	client, region, err := c.newClient(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	c.clients[key] = cachedClient{client: client, region: region}
+	return client, region, nil
+}
+
+// daemonCheck is a check scheduled by the daemon
+type daemonCheck struct {
+	config checkConfig
+	plugin *awsCWLogsInsightsPlugin
+
+	// cancel and done are set while the check is scheduled
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start schedules the check until ctx is done or stop is called
+func (d *daemon) start(ctx context.Context, c *daemonCheck) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		d.schedule(ctx, c)
+	}()
+}
+
+// stop cancels the check, and waits for it to stop. The running query is stopped by StopQuery.
+func (c *daemonCheck) stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+}
+
+// daemonResult is the latest result of a check
+type daemonResult struct {
+	*checkResult
+	UpdatedAt time.Time
+}
+
+// daemon runs checks on their intervals, and keeps the latest results
+type daemon struct {
+	config *daemonConfig
+	// configFile is read again on reload
+	configFile string
+	clients    *clientCache
+	store      *memoryStateStore
+	// slots limits queries running at once
+	slots chan struct{}
+	now   func() time.Time
+
+	mu      sync.Mutex
+	checks  []*daemonCheck
+	results map[string]*daemonResult
+	metrics daemonMetrics
+}
+
+// newDaemon creates the plugin of each check with clients shared by newClient
+func newDaemon(ctx context.Context, cfg *daemonConfig, newClient clientFunc) (*daemon, error) {
+	d := &daemon{
+		config:  cfg,
+		clients: newClientCache(newClient),
+		store:   newMemoryStateStore(fileStateStore{}),
+		slots:   make(chan struct{}, cfg.MaxConcurrentQueries),
+		now:     time.Now,
+		results: map[string]*daemonResult{},
+		metrics: daemonMetrics{},
+	}
+	for _, c := range cfg.Checks {
+		dc, err := d.newCheck(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		d.checks = append(d.checks, dc)
+	}
+	return d, nil
+}
+
+func (d *daemon) newCheck(ctx context.Context, c checkConfig) (*daemonCheck, error) {
+	opts, err := c.parseCheckArgs()
+	if err != nil {
+		return nil, fmt.Errorf("check %q: %w", c.Name, err)
+	}
+	p, err := newCWLogsInsightsPluginWithClient(ctx, opts, c.Args, d.clients.get, nil)
+	if err != nil {
+		return nil, fmt.Errorf("check %q: %w", c.Name, err)
+	}
+	p.store = d.store
+	return &daemonCheck{config: c, plugin: p}, nil
+}
+
+// runCheck runs the check once when a slot is available, and records the result
+func (d *daemon) runCheck(ctx context.Context, c *daemonCheck) {
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	defer func() { <-d.slots }()
+
+	runCtx, cancel := context.WithTimeout(ctx, c.plugin.Timeout)
+	defer cancel()
+	started := time.Now()
+	var r *checkResult
+	opts, err := c.plugin.reloadQueryDefinition(runCtx, started)
+	if err != nil {
+		r = &checkResult{Checker: c.plugin.errorChecker(err, c.plugin.lastStatus), opts: c.plugin.logOpts, err: err}
+	} else {
+		if opts != c.plugin.logOpts {
+			// report reads the options of the check under the lock
+			d.mu.Lock()
+			c.plugin.logOpts = opts
+			d.mu.Unlock()
+		}
+		r = c.plugin.run(runCtx)
+	}
+	elapsed := time.Since(started)
+	// the result of the run cancelled by the shutdown is not meaningful
+	if ctx.Err() != nil {
+		return
+	}
+	logger.Debugf("check %q: %s", c.config.Name, r.Checker)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	d.results[c.config.Name] = &daemonResult{checkResult: r, UpdatedAt: now}
+	d.metrics.record(c.config.Name, r, elapsed, now)
+}
+
+// schedule runs the check at once, and then on its interval until ctx is done
+func (d *daemon) schedule(ctx context.Context, c *daemonCheck) {
+	ticker := time.NewTicker(time.Duration(c.config.Interval))
+	defer ticker.Stop()
+	for {
+		d.runCheck(ctx, c)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// saveStates writes the states to the state files on interval until ctx is done
+func (d *daemon) saveStates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.store.flush(); err != nil {
+				logger.Warningf("failed to save states: %v", err)
+			}
+		}
+	}
+}
+
+// serve runs the checks and serves their results on ln until ctx is done.
+// Each receive from reload reads the config file again, and applies it.
+// The states are written to the state files before it returns.
+func (d *daemon) serve(ctx context.Context, ln net.Listener, reload <-chan os.Signal) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	srv := &http.Server{Handler: d.handler(), ReadHeaderTimeout: 10 * time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+
+	checks := d.checkList()
+	for _, c := range checks {
+		d.start(ctx, c)
+	}
+	saved := make(chan struct{})
+	saveInterval := time.Duration(d.config.SaveInterval)
+	go func() {
+		defer close(saved)
+		d.saveStates(ctx, saveInterval)
+	}()
+	logger.Infof("serving %d checks on %s", len(checks), ln.Addr())
+
+	var err error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case err = <-errCh:
+			break loop
+		case <-reload:
+			d.reloadConfig(ctx)
+		}
+	}
+	logger.Infof("shutting down")
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+		logger.Warningf("failed to shut down the HTTP server: %v", shutdownErr)
+	}
+	for _, c := range d.checkList() {
+		c.stop()
+	}
+	<-saved
+	if flushErr := d.store.flush(); flushErr != nil {
+		logger.Errorf("failed to save states: %v", flushErr)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// daemonReport is the latest result of a check served by the daemon
+type daemonReport struct {
+	Name string `json:"name"`
+	// UpdatedAt is null until the first run finishes
+	UpdatedAt *time.Time `json:"updated_at"`
+	// Stale is true when the check has not finished for two intervals and its timeout
+	Stale bool `json:"stale"`
+	jsonReport
+}
+
+// report returns the latest result of the check
+func (d *daemon) report(c *daemonCheck) *daemonReport {
+	d.mu.Lock()
+	res, ok := d.results[c.config.Name]
+	opts := c.plugin.logOpts
+	d.mu.Unlock()
+	if !ok {
+		r := &checkResult{Checker: checkers.Unknown("waiting for the first run"), opts: opts}
+		return &daemonReport{Name: c.config.Name, jsonReport: *r.report()}
+	}
+	updatedAt := res.UpdatedAt.UTC()
+	maxAge := 2*time.Duration(c.config.Interval) + opts.Timeout
+	return &daemonReport{
+		Name:       c.config.Name,
+		UpdatedAt:  &updatedAt,
+		Stale:      d.now().Sub(res.UpdatedAt) > maxAge,
+		jsonReport: *res.report(),
+	}
+}
+
+// checkList returns the current checks
+func (d *daemon) checkList() []*daemonCheck {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*daemonCheck(nil), d.checks...)
+}
+
+func (d *daemon) findCheck(name string) *daemonCheck {
+	for _, c := range d.checkList() {
+		if c.config.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// serveCommand runs the serve subcommand, which runs the checks in the config file on their intervals
+// and serves the latest results until it is terminated
+func serveCommand(args []string) int {
+	opts := &serveOpts{}
+	_, err := flags.ParseArgs(opts, args)
+	if err != nil {
+		return 1
+	}
+	if opts.Debug {
+		logging.SetLogLevel(logging.DEBUG)
+	}
+	cfg, err := loadDaemonConfig(opts.Config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	d, err := newDaemon(ctx, cfg, newClient)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	d.configFile = opts.Config
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	ln, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := d.serve(ctx, ln, reload); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
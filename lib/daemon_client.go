@@ -0,0 +1,75 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mackerelio/checkers"
+)
+
+// checkOpts are options of the check subcommand
+type checkOpts struct {
+	FromDaemon string        `long:"from-daemon" value-name:"ADDR" required:"true" description:"Address of the daemon run by the serve subcommand (e.g. 127.0.0.1:8931)"`
+	Name       string        `long:"name" value-name:"NAME" required:"true" description:"Name of the check in the config file of the daemon"`
+	Timeout    time.Duration `long:"timeout" value-name:"DURATION" default:"10s" description:"Timeout to get the result from the daemon"`
+}
+
+// daemonURL returns the URL of the result of the check
+func (opts *checkOpts) daemonURL() string {
+	base := opts.FromDaemon
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return strings.TrimRight(base, "/") + "/checks/" + url.PathEscape(opts.Name)
+}
+
+// fetchDaemonResult gets the latest result of the check from the daemon
+func fetchDaemonResult(ctx context.Context, opts *checkOpts) *checkers.Checker {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.daemonURL(), nil)
+	if err != nil {
+		return checkers.Unknown(err.Error())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return checkers.Unknown(fmt.Sprintf("failed to get the result from the daemon: %v", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return checkers.Unknown(fmt.Sprintf("failed to get the result from the daemon: %s: %s", resp.Status, strings.TrimSpace(string(b))))
+	}
+	var rep daemonReport
+	if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+		return checkers.Unknown(fmt.Sprintf("failed to parse the result from the daemon: %v", err))
+	}
+	if rep.Stale && rep.UpdatedAt != nil {
+		return checkers.Unknown(fmt.Sprintf("stale result updated at %s: %s", rep.UpdatedAt.Format(time.RFC3339), rep.Message))
+	}
+	status, ok := statusByName[rep.Status]
+	if !ok {
+		return checkers.Unknown(fmt.Sprintf("unexpected status from the daemon: %s", rep.Status))
+	}
+	return checkers.NewChecker(status, rep.Message)
+}
+
+// checkCommand runs the check subcommand, which prints the latest result of the check run by the daemon
+func checkCommand(args []string) int {
+	opts := &checkOpts{}
+	_, err := flags.ParseArgs(opts, args)
+	if err != nil {
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	ckr := fetchDaemonResult(ctx, opts)
+	ckr.Name = "CloudWatch Logs Insights"
+	fmt.Println(ckr.String())
+	return int(ckr.Status)
+}
@@ -0,0 +1,70 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// handler serves the results of the checks:
+//
+//   - /healthz responds 200 while the daemon is running
+//   - /checks lists the latest results of all checks
+//   - /checks/{name} is the latest result of the check, used by the check subcommand
+//   - /metrics exposes metrics of the checks in the Prometheus text format
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := io.WriteString(w, "ok\n"); err != nil {
+			logger.Warningf("failed to write the response: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /checks", func(w http.ResponseWriter, r *http.Request) {
+		checks := d.checkList()
+		reports := make([]*daemonReport, 0, len(checks))
+		for _, c := range checks {
+			reports = append(reports, d.report(c))
+		}
+		writeJSONResponse(w, reports)
+	})
+	mux.HandleFunc("GET /checks/{name}", func(w http.ResponseWriter, r *http.Request) {
+		c := d.findCheck(r.PathValue("name"))
+		if c == nil {
+			http.Error(w, "check not found", http.StatusNotFound)
+			return
+		}
+		writeJSONResponse(w, d.report(c))
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		names := d.checkNames()
+		// a slow client must not block the checks recording their results
+		d.mu.Lock()
+		m := d.metrics.snapshot(names)
+		d.mu.Unlock()
+		if err := m.write(w, names); err != nil {
+			logger.Warningf("failed to write metrics: %v", err)
+		}
+	})
+	return mux
+}
+
+func (d *daemon) checkNames() []string {
+	checks := d.checkList()
+	names := make([]string, 0, len(checks))
+	for _, c := range checks {
+		names = append(names, c.config.Name)
+	}
+	return names
+}
+
+func writeJSONResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Warningf("failed to write the response: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// reloadChanges are the names of checks changed by a reload
+type reloadChanges struct {
+	Added, Removed, Changed, Unchanged []string
+}
+
+func (rc *reloadChanges) String() string {
+	names := func(ns []string) string {
+		if len(ns) == 0 {
+			return ""
+		}
+		return " (" + strings.Join(ns, ", ") + ")"
+	}
+	return fmt.Sprintf("%d added%s, %d removed%s, %d changed%s, %d unchanged",
+		len(rc.Added), names(rc.Added), len(rc.Removed), names(rc.Removed),
+		len(rc.Changed), names(rc.Changed), len(rc.Unchanged))
+}
+
+// reloadConfig reads the config file again, and applies it.
+// The current checks are kept running when the config is invalid.
+func (d *daemon) reloadConfig(ctx context.Context) {
+	logger.Infof("reloading config %s", d.configFile)
+	cfg, err := loadDaemonConfig(d.configFile)
+	if err != nil {
+		logger.Errorf("failed to reload config, keeping the current checks: %v", err)
+		return
+	}
+	rc, err := d.apply(ctx, cfg)
+	if err != nil {
+		logger.Errorf("failed to reload config, keeping the current checks: %v", err)
+		return
+	}
+	logger.Infof("reloaded config: %s", rc)
+}
+
+// apply replaces the checks with those in cfg. Unchanged checks keep running with their states,
+// and removed or changed checks are stopped after their running queries are stopped.
+// Nothing is changed when any new check is invalid.
+// apply is called only by the goroutine of serve, which also reads d.config.
+func (d *daemon) apply(ctx context.Context, cfg *daemonConfig) (*reloadChanges, error) {
+	if cfg.MaxConcurrentQueries != d.config.MaxConcurrentQueries {
+		logger.Warningf("max_concurrent_queries is changed, but it takes effect after restarting")
+	}
+	if cfg.SaveInterval != d.config.SaveInterval {
+		logger.Warningf("save_interval is changed, but it takes effect after restarting")
+	}
+
+	current := map[string]*daemonCheck{}
+	for _, c := range d.checkList() {
+		current[c.config.Name] = c
+	}
+	rc := &reloadChanges{}
+	checks := make([]*daemonCheck, 0, len(cfg.Checks))
+	var started, stopped []*daemonCheck
+	for _, conf := range cfg.Checks {
+		old, ok := current[conf.Name]
+		if ok && reflect.DeepEqual(old.config, conf) {
+			rc.Unchanged = append(rc.Unchanged, conf.Name)
+			checks = append(checks, old)
+			delete(current, conf.Name)
+			continue
+		}
+		c, err := d.newCheck(ctx, conf)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rc.Changed = append(rc.Changed, conf.Name)
+			stopped = append(stopped, old)
+			delete(current, conf.Name)
+		} else {
+			rc.Added = append(rc.Added, conf.Name)
+		}
+		checks = append(checks, c)
+		started = append(started, c)
+	}
+	for _, c := range d.checkList() {
+		if _, ok := current[c.config.Name]; ok {
+			rc.Removed = append(rc.Removed, c.config.Name)
+			stopped = append(stopped, c)
+		}
+	}
+
+	for _, c := range stopped {
+		c.stop()
+	}
+	inUse := map[string]bool{}
+	for _, c := range checks {
+		inUse[c.plugin.StateFile] = true
+	}
+	for _, c := range stopped {
+		if inUse[c.plugin.StateFile] {
+			continue
+		}
+		for _, path := range []string{c.plugin.StateFile, c.plugin.baselineFile()} {
+			if err := d.store.forget(path); err != nil {
+				logger.Warningf("failed to save the state of check %q: %v", c.config.Name, err)
+			}
+		}
+	}
+
+	d.mu.Lock()
+	for _, name := range rc.Removed {
+		delete(d.results, name)
+		delete(d.metrics, name)
+	}
+	// the results of changed checks are kept until the first runs with the new config
+	d.checks = checks
+	d.mu.Unlock()
+	// max_concurrent_queries and save_interval keep the values in effect until restarting,
+	// so that the next reload compares with them
+	applied := *cfg
+	applied.MaxConcurrentQueries = d.config.MaxConcurrentQueries
+	applied.SaveInterval = d.config.SaveInterval
+	d.config = &applied
+
+	for _, c := range started {
+		d.start(ctx, c)
+	}
+	return rc, nil
+}
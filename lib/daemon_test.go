@@ -0,0 +1,309 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/mackerelio/checkers"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_loadDaemonConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *daemonConfig
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			content: `{"checks": [
+				{"name": "foo", "args": ["--log-group-name=/log/foo", "--filter=filter @message like /omg/"]},
+				{"name": "bar", "interval": "5m", "args": ["--log-group-name=/log/bar", "--filter=filter @message like /omg/"]}
+			]}`,
+			want: &daemonConfig{
+				MaxConcurrentQueries: 10,
+				SaveInterval:         duration(time.Minute),
+				Checks: []checkConfig{
+					{Name: "foo", Interval: duration(time.Minute), Args: []string{"--log-group-name=/log/foo", "--filter=filter @message like /omg/"}},
+					{Name: "bar", Interval: duration(5 * time.Minute), Args: []string{"--log-group-name=/log/bar", "--filter=filter @message like /omg/"}},
+				},
+			},
+		},
+		{
+			name:    "duplicate name",
+			content: `{"checks": [{"name": "foo"}, {"name": "foo"}]}`,
+			wantErr: `check "foo": duplicate name`,
+		},
+		{
+			name:    "missing name",
+			content: `{"checks": [{"interval": "1m"}]}`,
+			wantErr: `checks[0]: name is required`,
+		},
+		{
+			name:    "invalid interval",
+			content: `{"checks": [{"name": "foo", "interval": 60}]}`,
+			wantErr: `duration must be a string like "1m"`,
+		},
+		{
+			name:    "unknown field",
+			content: `{"check": []}`,
+			wantErr: `json: unknown field "check"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(file, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadDaemonConfig(file)
+			if (err == nil && tt.wantErr != "") || (err != nil && (tt.wantErr == "" || !strings.Contains(err.Error(), tt.wantErr))) {
+				t.Fatalf("loadDaemonConfig() error = %v, want %q", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadDaemonConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestDaemon(t *testing.T, svc Client, checks ...checkConfig) *daemon {
+	t.Helper()
+	var created int
+	newClient := func(context.Context, *logOpts) (Client, string, error) {
+		created++
+		return svc, "ap-northeast-1", nil
+	}
+	d, err := newDaemon(context.Background(), &daemonConfig{MaxConcurrentQueries: 1, SaveInterval: duration(time.Minute), Checks: checks}, newClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 {
+		t.Errorf("created %d clients, want 1 shared client", created)
+	}
+	return d
+}
+
+func Test_daemon(t *testing.T) {
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+		QueryId: aws.String("DUMMY-QUERY-ID"),
+	}, nil)
+	svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+		Status:     types.QueryStatusComplete,
+		Statistics: &types.QueryStatistics{RecordsMatched: 3},
+	}, nil)
+	stateDir := t.TempDir()
+	args := func(logGroup string) []string {
+		return []string{"--log-group-name", logGroup, "--filter", "filter @message like /omg/", "--warning-over", "1", "--critical-over", "5", "--state-dir", stateDir}
+	}
+	d := newTestDaemon(t, svc,
+		checkConfig{Name: "foo", Interval: duration(time.Minute), Args: args("/log/foo")},
+		checkConfig{Name: "bar", Interval: duration(time.Minute), Args: args("/log/bar")},
+	)
+	srv := httptest.NewServer(d.handler())
+	defer srv.Close()
+	fetch := func(name string) *checkers.Checker {
+		return fetchDaemonResult(context.Background(), &checkOpts{FromDaemon: srv.URL, Name: name})
+	}
+
+	if got, want := fetch("foo"), checkers.Unknown("waiting for the first run"); !reflect.DeepEqual(got, want) {
+		t.Errorf("result before the first run = %v, want %v", got, want)
+	}
+
+	now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+	d.runCheck(context.Background(), d.findCheck("foo"))
+	if got, want := fetch("foo"), checkers.Warning("3 > 1 messages"); !reflect.DeepEqual(got, want) {
+		t.Errorf("result = %v, want %v", got, want)
+	}
+	if got := fetch("missing"); got.Status != checkers.UNKNOWN || !strings.Contains(got.Message, "404 Not Found") {
+		t.Errorf("result of missing check = %v", got)
+	}
+
+	// states are written by flush
+	stateFile := d.findCheck("foo").plugin.StateFile
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file is written before flush: %v", err)
+	}
+	if err := d.store.flush(); err != nil {
+		t.Fatal(err)
+	}
+	var s logState
+	if err := loadJSON(fileStateStore{}, stateFile, &s); err != nil || s.LastStatus != "WARNING" {
+		t.Errorf("saved state = %+v, %v", s, err)
+	}
+
+	// results not updated for two intervals and the timeout are stale
+	now = now.Add(3*time.Minute + time.Second)
+	if got := fetch("foo"); got.Status != checkers.UNKNOWN || got.Message != "stale result updated at 2020-10-12T03:00:00Z: 3 > 1 messages" {
+		t.Errorf("stale result = %v", got)
+	}
+}
+
+func Test_daemon_handler(t *testing.T) {
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+		QueryId: aws.String("DUMMY-QUERY-ID"),
+	}, nil)
+	svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+		Status:     types.QueryStatusComplete,
+		Statistics: &types.QueryStatistics{RecordsMatched: 3, RecordsScanned: 10, BytesScanned: 1024},
+	}, nil)
+	args := []string{"--log-group-name", "/log/foo", "--filter", "filter @message like /omg/", "--state-dir", t.TempDir()}
+	d := newTestDaemon(t, svc,
+		checkConfig{Name: "foo", Interval: duration(time.Minute), Args: args},
+		checkConfig{Name: "bar", Interval: duration(time.Minute), Args: append(args, "--warning-over", "5")},
+	)
+	d.runCheck(context.Background(), d.findCheck("foo"))
+	srv := httptest.NewServer(d.handler())
+	defer srv.Close()
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	if code, body := get("/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("/healthz = %d %q", code, body)
+	}
+
+	code, body := get("/checks")
+	if code != http.StatusOK {
+		t.Fatalf("/checks = %d %q", code, body)
+	}
+	var reports []struct {
+		Name         string     `json:"name"`
+		UpdatedAt    *time.Time `json:"updated_at"`
+		Status       string     `json:"status"`
+		MatchedCount *int       `json:"matched_count"`
+		Window       *struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"window"`
+	}
+	if err := json.Unmarshal([]byte(body), &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0].Name != "foo" || reports[1].Name != "bar" {
+		t.Fatalf("/checks = %s", body)
+	}
+	if r := reports[0]; r.Status != "CRITICAL" || r.MatchedCount == nil || *r.MatchedCount != 3 || r.UpdatedAt == nil || r.Window == nil || r.Window.End.Sub(r.Window.Start) != time.Minute {
+		t.Errorf("/checks[0] = %+v", r)
+	}
+	if r := reports[1]; r.Status != "UNKNOWN" || r.MatchedCount != nil || r.UpdatedAt != nil {
+		t.Errorf("/checks[1] = %+v", r)
+	}
+
+	code, body = get("/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("/metrics = %d %q", code, body)
+	}
+	for _, want := range []string{
+		`cwlogs_insights_check_runs_total{check="foo"} 1`,
+		`cwlogs_insights_check_runs_total{check="bar"} 0`,
+		`cwlogs_insights_check_matched_count{check="foo"} 3`,
+		`cwlogs_insights_check_bytes_scanned_total{check="foo"} 1024`,
+		`cwlogs_insights_check_status{check="foo"} 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("/metrics doesn't contain %q: %s", want, body)
+		}
+	}
+}
+
+func Test_daemon_apply(t *testing.T) {
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+		QueryId: aws.String("DUMMY-QUERY-ID"),
+	}, nil)
+	svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+		Status:     types.QueryStatusComplete,
+		Statistics: &types.QueryStatistics{RecordsMatched: 3},
+	}, nil)
+	// queries of stopped checks are stopped
+	svc.On("StopQuery", mock.Anything).Return(&cloudwatchlogs.StopQueryOutput{}, nil)
+	stateDir := t.TempDir()
+	args := func(logGroup string) []string {
+		return []string{"--log-group-name", logGroup, "--filter", "filter @message like /omg/", "--state-dir", stateDir}
+	}
+	check := func(name string, interval time.Duration) checkConfig {
+		return checkConfig{Name: name, Interval: duration(interval), Args: args("/log/" + name)}
+	}
+	d := newTestDaemon(t, svc, check("foo", time.Hour), check("bar", time.Hour), check("qux", time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		for _, c := range d.checkList() {
+			c.stop()
+		}
+	}()
+	foo, bar := d.findCheck("foo"), d.findCheck("bar")
+	d.runCheck(ctx, bar)
+
+	// invalid checks leave the current checks as they are
+	if _, err := d.apply(ctx, &daemonConfig{MaxConcurrentQueries: 1, SaveInterval: duration(time.Minute), Checks: []checkConfig{{Name: "foo", Args: []string{"--unknown"}}}}); err == nil {
+		t.Errorf("apply() with an invalid check succeeded")
+	}
+	if got := d.checkNames(); !reflect.DeepEqual(got, []string{"foo", "bar", "qux"}) {
+		t.Errorf("checks after invalid apply() = %v", got)
+	}
+
+	cfg := &daemonConfig{MaxConcurrentQueries: 4, SaveInterval: duration(5 * time.Minute), Checks: []checkConfig{check("foo", time.Hour), check("baz", time.Hour), check("qux", 2*time.Hour)}}
+	rc, err := d.apply(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the checks are replaced, but the settings taking effect after restarting are not
+	wantConfig := &daemonConfig{MaxConcurrentQueries: 1, SaveInterval: duration(time.Minute), Checks: cfg.Checks}
+	if !reflect.DeepEqual(d.config, wantConfig) {
+		t.Errorf("config = %+v, want %+v", d.config, wantConfig)
+	}
+	want := &reloadChanges{Added: []string{"baz"}, Removed: []string{"bar"}, Changed: []string{"qux"}, Unchanged: []string{"foo"}}
+	if !reflect.DeepEqual(rc, want) {
+		t.Errorf("apply() = %+v, want %+v", rc, want)
+	}
+	if got := rc.String(); got != "1 added (baz), 1 removed (bar), 1 changed (qux), 1 unchanged" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := d.checkNames(); !reflect.DeepEqual(got, []string{"foo", "baz", "qux"}) {
+		t.Errorf("checks = %v", got)
+	}
+	if d.findCheck("foo") != foo {
+		t.Errorf("unchanged check is recreated")
+	}
+
+	// the result of the removed check is dropped, and its state is written
+	d.mu.Lock()
+	_, hasResult := d.results["bar"]
+	_, hasMetrics := d.metrics["bar"]
+	d.mu.Unlock()
+	if hasResult || hasMetrics {
+		t.Errorf("result or metrics of the removed check are kept")
+	}
+	var s logState
+	if err := loadJSON(fileStateStore{}, bar.plugin.StateFile, &s); err != nil || s.LastStatus == "" {
+		t.Errorf("state of the removed check = %+v, %v", s, err)
+	}
+}
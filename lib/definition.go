@@ -0,0 +1,222 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/natefinch/atomic"
+)
+
+// queryDefinition is a saved query of CloudWatch Logs Insights
+type queryDefinition struct {
+	ID            string
+	Name          string
+	QueryString   string
+	LogGroupNames []string `json:",omitempty"`
+	// QueryLanguage is the value for --query-language, or empty if unknown
+	QueryLanguage string `json:",omitempty"`
+}
+
+// queryDefinitionCache is the content of the cache file of a query definition
+type queryDefinitionCache struct {
+	FetchedAt  int64
+	Definition *queryDefinition
+}
+
+// queryDefinitionError is returned when the query definition is missing or ambiguous
+type queryDefinitionError struct {
+	msg string
+}
+
+func (e *queryDefinitionError) Error() string { return e.msg }
+
+// findQueryDefinition looks up the query definition by its name or ID through DescribeQueryDefinitions.
+// A name has to match exactly one definition.
+func (p *awsCWLogsInsightsPlugin) findQueryDefinition(ctx context.Context, nameOrID string) (*queryDefinition, error) {
+	var byName, byID []*queryDefinition
+	collect := func(prefix *string) error {
+		input := &cloudwatchlogs.DescribeQueryDefinitionsInput{
+			QueryDefinitionNamePrefix: prefix,
+			MaxResults:                aws.Int32(1000),
+		}
+		for {
+			out, err := p.Service.DescribeQueryDefinitions(ctx, input)
+			if err != nil {
+				return fmt.Errorf("failed to describe query definitions: %w", err)
+			}
+			for _, d := range out.QueryDefinitions {
+				def := &queryDefinition{
+					ID:            aws.ToString(d.QueryDefinitionId),
+					Name:          aws.ToString(d.Name),
+					QueryString:   aws.ToString(d.QueryString),
+					LogGroupNames: d.LogGroupNames,
+					QueryLanguage: strings.ToLower(string(d.QueryLanguage)),
+				}
+				if def.Name == nameOrID {
+					byName = append(byName, def)
+				} else if def.ID == nameOrID {
+					byID = append(byID, def)
+				}
+			}
+			if aws.ToString(out.NextToken) == "" {
+				return nil
+			}
+			input.NextToken = out.NextToken
+		}
+	}
+	// names are looked up by the prefix first, not to list all definitions
+	if err := collect(aws.String(nameOrID)); err != nil {
+		return nil, err
+	}
+	if len(byName) == 0 {
+		if err := collect(nil); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case len(byName) == 1:
+		return byName[0], nil
+	case len(byName) > 1:
+		ids := make([]string, len(byName))
+		for i, def := range byName {
+			ids[i] = def.ID
+		}
+		return nil, &queryDefinitionError{fmt.Sprintf("query definition %q is ambiguous: %d definitions have the name (%s). Specify one by its ID", nameOrID, len(byName), strings.Join(ids, ", "))}
+	case len(byID) == 1:
+		return byID[0], nil
+	}
+	return nil, &queryDefinitionError{fmt.Sprintf("query definition %q is not found", nameOrID)}
+}
+
+// queryDefinitionCacheFile returns the path of the cache file for --query-definition.
+// Like the state file, it is keyed by the credentials, region and endpoint,
+// since saved queries of the same name may differ between accounts and regions.
+func (p *awsCWLogsInsightsPlugin) queryDefinitionCacheFile() string {
+	key := strings.Join(
+		append(p.identity[:len(p.identity):len(p.identity)], p.Region, p.EndpointURL, p.QueryDefinition),
+		" ",
+	)
+	return filepath.Join(p.StateDir, fmt.Sprintf("query-definition-%x.json", md5.Sum([]byte(key))))
+}
+
+// loadQueryDefinition resolves --query-definition, and applies it to the options.
+func (p *awsCWLogsInsightsPlugin) loadQueryDefinition(ctx context.Context, now time.Time) error {
+	def, err := p.resolveQueryDefinition(ctx, now)
+	if err != nil {
+		return err
+	}
+	if p.givenOpts == nil {
+		given := *p.logOpts
+		p.givenOpts = &given
+	}
+	p.applyQueryDefinition(p.logOpts, def)
+	p.definitionFresh = true
+	return nil
+}
+
+// resolveQueryDefinition looks up --query-definition, and records when it should be resolved again.
+// Definitions are cached in the state dir for --query-definition-ttl.
+// An expired cache is used when DescribeQueryDefinitions fails, but not when the definition is missing or ambiguous.
+func (p *awsCWLogsInsightsPlugin) resolveQueryDefinition(ctx context.Context, now time.Time) (*queryDefinition, error) {
+	file := p.queryDefinitionCacheFile()
+	var cache queryDefinitionCache
+	if b, err := os.ReadFile(file); err == nil {
+		if err := json.Unmarshal(b, &cache); err != nil {
+			logger.Warningf("ignoring the broken cache of the query definition: %v", err)
+			cache = queryDefinitionCache{}
+		}
+	}
+	def := cache.Definition
+	p.definitionExpiry = time.Unix(cache.FetchedAt, 0).Add(p.QueryDefinitionTTL)
+	if def == nil || !now.Before(p.definitionExpiry) {
+		fetched, err := p.findQueryDefinition(ctx, p.QueryDefinition)
+		var defErr *queryDefinitionError
+		switch {
+		case err == nil:
+			def = fetched
+			p.definitionExpiry = now.Add(p.QueryDefinitionTTL)
+			if p.QueryDefinitionTTL > 0 {
+				if err := saveQueryDefinitionCache(file, &queryDefinitionCache{FetchedAt: now.Unix(), Definition: def}); err != nil {
+					logger.Warningf("failed to cache the query definition: %v", err)
+				}
+			}
+		case def != nil && !errors.As(err, &defErr):
+			logger.Warningf("using the expired cache of the query definition: %v", err)
+		default:
+			return nil, err
+		}
+	}
+	logger.Debugf("query definition %s (%s): %s", def.Name, def.ID, def.QueryString)
+	return def, nil
+}
+
+// applyQueryDefinition sets the query of def to opts. The log groups of def are used unless --log-group-name is given.
+func (p *awsCWLogsInsightsPlugin) applyQueryDefinition(opts *logOpts, def *queryDefinition) {
+	opts.Filter = def.QueryString
+	if def.QueryLanguage != "" {
+		opts.QueryLanguage = def.QueryLanguage
+	}
+	if len(opts.LogGroupNames) == 0 && opts.QueryLanguage != "sql" {
+		opts.LogGroupNames = def.LogGroupNames
+	}
+}
+
+// reloadQueryDefinition resolves --query-definition again when its TTL has expired,
+// so that checks running for a long time pick up edits of the saved query.
+// It returns the options with the definition applied, which the caller sets to the plugin.
+// The current definition is kept when DescribeQueryDefinitions fails.
+func (p *awsCWLogsInsightsPlugin) reloadQueryDefinition(ctx context.Context, now time.Time) (*logOpts, error) {
+	// the definition loaded by the build is used by the first run, even without the cache
+	fresh := p.definitionFresh
+	p.definitionFresh = false
+	if p.givenOpts == nil || fresh || now.Before(p.definitionExpiry) {
+		return p.logOpts, nil
+	}
+	def, err := p.resolveQueryDefinition(ctx, now)
+	var defErr *queryDefinitionError
+	if errors.As(err, &defErr) {
+		return nil, err
+	}
+	if err != nil {
+		logger.Warningf("keeping the current query definition: %v", err)
+		return p.logOpts, nil
+	}
+	opts := *p.logOpts
+	opts.Filter, opts.QueryLanguage, opts.LogGroupNames = p.givenOpts.Filter, p.givenOpts.QueryLanguage, p.givenOpts.LogGroupNames
+	p.applyQueryDefinition(&opts, def)
+	if opts.isFilterTemplate() {
+		if err := opts.renderFilter(p.Region); err != nil {
+			return nil, withClass(ErrorClassInvalid, err)
+		}
+	}
+	if opts.Filter == p.Filter && opts.QueryLanguage == p.QueryLanguage && reflect.DeepEqual(opts.LogGroupNames, p.LogGroupNames) {
+		return p.logOpts, nil
+	}
+	if err := opts.checkQuery(); err != nil {
+		return nil, err
+	}
+	logger.Infof("query definition %s is updated", p.QueryDefinition)
+	return &opts, nil
+}
+
+func saveQueryDefinitionCache(file string, cache *queryDefinitionCache) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(cache); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return atomic.WriteFile(file, &buf)
+}
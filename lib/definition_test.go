@@ -0,0 +1,300 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+func Test_awsCWLogsInsightsPlugin_findQueryDefinition(t *testing.T) {
+	errorsDef := types.QueryDefinition{
+		QueryDefinitionId: aws.String("11111111-aaaa-bbbb-cccc-000000000001"),
+		Name:              aws.String("app/errors"),
+		QueryString:       aws.String("filter level = 'error'"),
+		LogGroupNames:     []string{"/log/foo"},
+		QueryLanguage:     types.QueryLanguageCwli,
+	}
+	errorsV2Def := types.QueryDefinition{
+		QueryDefinitionId: aws.String("11111111-aaaa-bbbb-cccc-000000000002"),
+		Name:              aws.String("app/errors-v2"),
+		QueryString:       aws.String("filter level = 'error' and version = 2"),
+	}
+	dupDef := types.QueryDefinition{
+		QueryDefinitionId: aws.String("11111111-aaaa-bbbb-cccc-000000000003"),
+		Name:              aws.String("app/errors"),
+		QueryString:       aws.String("filter @message like /error/"),
+	}
+	wantErrorsDef := &queryDefinition{
+		ID:            "11111111-aaaa-bbbb-cccc-000000000001",
+		Name:          "app/errors",
+		QueryString:   "filter level = 'error'",
+		LogGroupNames: []string{"/log/foo"},
+		QueryLanguage: "cwli",
+	}
+	type call struct {
+		input *cloudwatchlogs.DescribeQueryDefinitionsInput
+		out   *cloudwatchlogs.DescribeQueryDefinitionsOutput
+	}
+	tests := []struct {
+		name     string
+		nameOrID string
+		calls    []call
+		want     *queryDefinition
+		wantErr  string
+	}{
+		{
+			name:     "by name",
+			nameOrID: "app/errors",
+			calls: []call{
+				{
+					input: &cloudwatchlogs.DescribeQueryDefinitionsInput{QueryDefinitionNamePrefix: aws.String("app/errors"), MaxResults: aws.Int32(1000)},
+					out:   &cloudwatchlogs.DescribeQueryDefinitionsOutput{QueryDefinitions: []types.QueryDefinition{errorsDef, errorsV2Def}},
+				},
+			},
+			want: wantErrorsDef,
+		},
+		{
+			name:     "by ID over pages",
+			nameOrID: "11111111-aaaa-bbbb-cccc-000000000001",
+			calls: []call{
+				{
+					input: &cloudwatchlogs.DescribeQueryDefinitionsInput{QueryDefinitionNamePrefix: aws.String("11111111-aaaa-bbbb-cccc-000000000001"), MaxResults: aws.Int32(1000)},
+					out:   &cloudwatchlogs.DescribeQueryDefinitionsOutput{},
+				},
+				{
+					input: &cloudwatchlogs.DescribeQueryDefinitionsInput{MaxResults: aws.Int32(1000)},
+					out:   &cloudwatchlogs.DescribeQueryDefinitionsOutput{QueryDefinitions: []types.QueryDefinition{errorsV2Def}, NextToken: aws.String("next")},
+				},
+				{
+					input: &cloudwatchlogs.DescribeQueryDefinitionsInput{MaxResults: aws.Int32(1000), NextToken: aws.String("next")},
+					out:   &cloudwatchlogs.DescribeQueryDefinitionsOutput{QueryDefinitions: []types.QueryDefinition{errorsDef}},
+				},
+			},
+			want: wantErrorsDef,
+		},
+		{
+			name:     "ambiguous",
+			nameOrID: "app/errors",
+			calls: []call{
+				{
+					input: &cloudwatchlogs.DescribeQueryDefinitionsInput{QueryDefinitionNamePrefix: aws.String("app/errors"), MaxResults: aws.Int32(1000)},
+					out:   &cloudwatchlogs.DescribeQueryDefinitionsOutput{QueryDefinitions: []types.QueryDefinition{errorsDef, dupDef}},
+				},
+			},
+			wantErr: `query definition "app/errors" is ambiguous: 2 definitions have the name (11111111-aaaa-bbbb-cccc-000000000001, 11111111-aaaa-bbbb-cccc-000000000003). Specify one by its ID`,
+		},
+		{
+			name:     "not found",
+			nameOrID: "app/err",
+			calls: []call{
+				{
+					input: &cloudwatchlogs.DescribeQueryDefinitionsInput{QueryDefinitionNamePrefix: aws.String("app/err"), MaxResults: aws.Int32(1000)},
+					out:   &cloudwatchlogs.DescribeQueryDefinitionsOutput{QueryDefinitions: []types.QueryDefinition{errorsDef, errorsV2Def}},
+				},
+				{
+					input: &cloudwatchlogs.DescribeQueryDefinitionsInput{MaxResults: aws.Int32(1000)},
+					out:   &cloudwatchlogs.DescribeQueryDefinitionsOutput{QueryDefinitions: []types.QueryDefinition{errorsDef, errorsV2Def}},
+				},
+			},
+			wantErr: `query definition "app/err" is not found`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockAWSCloudWatchLogsClient{}
+			for _, c := range tt.calls {
+				svc.On("DescribeQueryDefinitions", c.input).Return(c.out, nil).Once()
+			}
+			p := &awsCWLogsInsightsPlugin{Service: svc, logOpts: &logOpts{}}
+			got, err := p.findQueryDefinition(context.Background(), tt.nameOrID)
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Fatalf("awsCWLogsInsightsPlugin.findQueryDefinition() error = %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("awsCWLogsInsightsPlugin.findQueryDefinition() = %+v, want %+v", got, tt.want)
+			}
+			svc.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_loadQueryDefinition(t *testing.T) {
+	now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	input := &cloudwatchlogs.DescribeQueryDefinitionsInput{QueryDefinitionNamePrefix: aws.String("app/errors"), MaxResults: aws.Int32(1000)}
+	out := &cloudwatchlogs.DescribeQueryDefinitionsOutput{
+		QueryDefinitions: []types.QueryDefinition{
+			{
+				QueryDefinitionId: aws.String("11111111-aaaa-bbbb-cccc-000000000001"),
+				Name:              aws.String("app/errors"),
+				QueryString:       aws.String("filter level = 'error'"),
+				LogGroupNames:     []string{"/log/foo"},
+			},
+		},
+	}
+	stateDir := t.TempDir()
+	newPlugin := func(svc Client) *awsCWLogsInsightsPlugin {
+		return &awsCWLogsInsightsPlugin{
+			Service: svc,
+			logOpts: &logOpts{StateDir: stateDir, QueryDefinition: "app/errors", QueryDefinitionTTL: time.Hour},
+		}
+	}
+
+	// the first run fetches and caches the definition
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("DescribeQueryDefinitions", input).Return(out, nil).Once()
+	p := newPlugin(svc)
+	if err := p.loadQueryDefinition(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if p.Filter != "filter level = 'error'" || !reflect.DeepEqual(p.LogGroupNames, []string{"/log/foo"}) {
+		t.Errorf("Filter = %q, LogGroupNames = %v", p.Filter, p.LogGroupNames)
+	}
+	svc.AssertExpectations(t)
+
+	// within the TTL, the cache is used
+	svc = &mockAWSCloudWatchLogsClient{}
+	p = newPlugin(svc)
+	p.LogGroupNames = []string{"/log/baz"}
+	if err := p.loadQueryDefinition(context.Background(), now.Add(59*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if p.Filter != "filter level = 'error'" || !reflect.DeepEqual(p.LogGroupNames, []string{"/log/baz"}) {
+		t.Errorf("Filter = %q, LogGroupNames = %v", p.Filter, p.LogGroupNames)
+	}
+	svc.AssertExpectations(t)
+
+	// after the TTL, the expired cache is used if the API fails
+	svc = &mockAWSCloudWatchLogsClient{}
+	svc.On("DescribeQueryDefinitions", input).Return(nil, errors.New("connection reset")).Once()
+	p = newPlugin(svc)
+	if err := p.loadQueryDefinition(context.Background(), now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if p.Filter != "filter level = 'error'" {
+		t.Errorf("Filter = %q", p.Filter)
+	}
+	svc.AssertExpectations(t)
+
+	// but not if the definition is removed
+	svc = &mockAWSCloudWatchLogsClient{}
+	svc.On("DescribeQueryDefinitions", input).Return(&cloudwatchlogs.DescribeQueryDefinitionsOutput{}, nil).Once()
+	svc.On("DescribeQueryDefinitions", &cloudwatchlogs.DescribeQueryDefinitionsInput{MaxResults: aws.Int32(1000)}).Return(&cloudwatchlogs.DescribeQueryDefinitionsOutput{}, nil).Once()
+	p = newPlugin(svc)
+	err := p.loadQueryDefinition(context.Background(), now.Add(2*time.Hour))
+	if err == nil || err.Error() != `query definition "app/errors" is not found` {
+		t.Errorf("loadQueryDefinition() error = %v", err)
+	}
+	svc.AssertExpectations(t)
+}
+
+func Test_awsCWLogsInsightsPlugin_loadQueryDefinition_regions(t *testing.T) {
+	now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	input := &cloudwatchlogs.DescribeQueryDefinitionsInput{QueryDefinitionNamePrefix: aws.String("app/errors"), MaxResults: aws.Int32(1000)}
+	stateDir := t.TempDir()
+	load := func(region, query string) *awsCWLogsInsightsPlugin {
+		t.Helper()
+		svc := &mockAWSCloudWatchLogsClient{}
+		svc.On("DescribeQueryDefinitions", input).Return(&cloudwatchlogs.DescribeQueryDefinitionsOutput{
+			QueryDefinitions: []types.QueryDefinition{
+				{
+					QueryDefinitionId: aws.String("11111111-aaaa-bbbb-cccc-000000000001"),
+					Name:              aws.String("app/errors"),
+					QueryString:       aws.String(query),
+					LogGroupNames:     []string{"/log/foo"},
+				},
+			},
+		}, nil).Once()
+		p := &awsCWLogsInsightsPlugin{
+			Service: svc,
+			Region:  region,
+			logOpts: &logOpts{StateDir: stateDir, QueryDefinition: "app/errors", QueryDefinitionTTL: time.Hour},
+		}
+		if err := p.loadQueryDefinition(context.Background(), now); err != nil {
+			t.Fatal(err)
+		}
+		svc.AssertExpectations(t)
+		return p
+	}
+
+	// the saved query of the same name in another region is fetched, not read from the cache
+	tokyo := load("ap-northeast-1", "filter level = 'error'")
+	virginia := load("us-east-1", "filter level = 'fatal'")
+	if tokyo.queryDefinitionCacheFile() == virginia.queryDefinitionCacheFile() {
+		t.Errorf("queryDefinitionCacheFile() = %q for both regions", tokyo.queryDefinitionCacheFile())
+	}
+	if tokyo.Filter != "filter level = 'error'" || virginia.Filter != "filter level = 'fatal'" {
+		t.Errorf("Filter = %q and %q", tokyo.Filter, virginia.Filter)
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_reloadQueryDefinition(t *testing.T) {
+	now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	input := &cloudwatchlogs.DescribeQueryDefinitionsInput{QueryDefinitionNamePrefix: aws.String("app/errors"), MaxResults: aws.Int32(1000)}
+	out := func(query string, logGroupNames ...string) *cloudwatchlogs.DescribeQueryDefinitionsOutput {
+		return &cloudwatchlogs.DescribeQueryDefinitionsOutput{
+			QueryDefinitions: []types.QueryDefinition{
+				{
+					QueryDefinitionId: aws.String("11111111-aaaa-bbbb-cccc-000000000001"),
+					Name:              aws.String("app/errors"),
+					QueryString:       aws.String(query),
+					LogGroupNames:     logGroupNames,
+				},
+			},
+		}
+	}
+	svc := &mockAWSCloudWatchLogsClient{}
+	p := &awsCWLogsInsightsPlugin{
+		Service: svc,
+		logOpts: &logOpts{StateDir: t.TempDir(), QueryDefinition: "app/errors", QueryDefinitionTTL: time.Hour, MinConsecutive: 1, RecoverAfter: 1},
+	}
+	svc.On("DescribeQueryDefinitions", input).Return(out("filter level = 'error'", "/log/foo"), nil).Once()
+	if err := p.loadQueryDefinition(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	reload := func(at time.Time) (*logOpts, error) {
+		t.Helper()
+		opts, err := p.reloadQueryDefinition(context.Background(), at)
+		svc.AssertExpectations(t)
+		return opts, err
+	}
+
+	// the loaded definition is used within the TTL
+	for _, at := range []time.Time{now, now.Add(59 * time.Minute)} {
+		if opts, err := reload(at); err != nil || opts != p.logOpts {
+			t.Errorf("reloadQueryDefinition() = %+v, %v, want the current options", opts, err)
+		}
+	}
+
+	// the edited definition is applied after the TTL
+	svc.On("DescribeQueryDefinitions", input).Return(out("filter level = 'fatal'", "/log/bar"), nil).Once()
+	opts, err := reload(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts == p.logOpts || opts.Filter != "filter level = 'fatal'" || !reflect.DeepEqual(opts.LogGroupNames, []string{"/log/bar"}) {
+		t.Errorf("Filter = %q, LogGroupNames = %v", opts.Filter, opts.LogGroupNames)
+	}
+	if p.Filter != "filter level = 'error'" {
+		t.Errorf("the current Filter = %q is changed", p.Filter)
+	}
+	p.logOpts = opts
+
+	// the current definition is kept if the API fails
+	svc.On("DescribeQueryDefinitions", input).Return(nil, errors.New("connection reset")).Once()
+	if opts, err := reload(now.Add(4 * time.Hour)); err != nil || opts != p.logOpts {
+		t.Errorf("reloadQueryDefinition() = %+v, %v, want the current options", opts, err)
+	}
+
+	// but not if the definition is removed
+	svc.On("DescribeQueryDefinitions", input).Return(&cloudwatchlogs.DescribeQueryDefinitionsOutput{}, nil).Once()
+	svc.On("DescribeQueryDefinitions", &cloudwatchlogs.DescribeQueryDefinitionsInput{MaxResults: aws.Int32(1000)}).Return(&cloudwatchlogs.DescribeQueryDefinitionsOutput{}, nil).Once()
+	if _, err := reload(now.Add(6 * time.Hour)); err == nil || err.Error() != `query definition "app/errors" is not found` {
+		t.Errorf("reloadQueryDefinition() error = %v", err)
+	}
+}
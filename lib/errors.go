@@ -0,0 +1,214 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	"github.com/mackerelio/checkers"
+)
+
+// Classes of errors. --on-error maps them to statuses, and Error has one of them as Class.
+const (
+	ErrorClassAuth     = "auth"
+	ErrorClassThrottle = "throttle"
+	ErrorClassQuery    = "query"
+	ErrorClassTimeout  = "timeout"
+	ErrorClassState    = "state"
+	ErrorClassInvalid  = "invalid"
+	ErrorClassOther    = "other"
+)
+
+var errorClasses = []string{
+	ErrorClassAuth,
+	ErrorClassThrottle,
+	ErrorClassQuery,
+	ErrorClassTimeout,
+	ErrorClassState,
+	ErrorClassInvalid,
+	ErrorClassOther,
+}
+
+// authErrorCodes are error codes of AWS APIs for missing permissions or invalid credentials
+var authErrorCodes = map[string]struct{}{
+	"AccessDenied":                {},
+	"AccessDeniedException":       {},
+	"UnauthorizedOperation":       {},
+	"UnrecognizedClientException": {},
+	"InvalidClientTokenId":        {},
+	"InvalidSignatureException":   {},
+	"SignatureDoesNotMatch":       {},
+	"ExpiredToken":                {},
+	"ExpiredTokenException":       {},
+	"MissingAuthenticationToken":  {},
+}
+
+// invalidQueryErrorCodes are error codes of CloudWatch Logs for queries it doesn't accept
+var invalidQueryErrorCodes = map[string]struct{}{
+	"MalformedQueryException":   {},
+	"InvalidParameterException": {},
+	"ResourceNotFoundException": {},
+}
+
+// Error is an error of a check with its class, one of the ErrorClass constants.
+// Checker returns errors of this type, and the underlying error is available by errors.As or errors.Is.
+type Error struct {
+	Class string
+	Err   error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// withClass marks err as an error of class
+func withClass(class string, err error) error {
+	return &Error{Class: class, Err: err}
+}
+
+// asError returns err as *Error classified by classifyError, or nil if err is nil
+func asError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Class: classifyError(err), Err: err}
+}
+
+// classifyError returns the class of err
+func classifyError(err error) string {
+	var ce *Error
+	if errors.As(err, &ce) {
+		return ce.Class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassQuery
+	}
+	var qdErr *queryDefinitionError
+	if errors.As(err, &qdErr) {
+		return ErrorClassInvalid
+	}
+	// all slots of --max-concurrent-queries stayed in use over the retries
+	if isThrottlingError(err) || errors.Is(err, errNoQuerySlot) {
+		return ErrorClassThrottle
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if _, ok := authErrorCodes[apiErr.ErrorCode()]; ok {
+			return ErrorClassAuth
+		}
+		if _, ok := invalidQueryErrorCodes[apiErr.ErrorCode()]; ok {
+			return ErrorClassInvalid
+		}
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrorClassAuth
+		case http.StatusTooManyRequests:
+			return ErrorClassThrottle
+		}
+	}
+	return ErrorClassOther
+}
+
+// parseOnError parses --on-error into statuses by the classes
+func parseOnError(specs []string) (map[string]string, error) {
+	statuses := map[string]string{}
+	for _, spec := range specs {
+		class, status, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --on-error %q: must be CLASS=STATUS", spec)
+		}
+		if !containsString(errorClasses, class) {
+			return nil, fmt.Errorf("invalid --on-error %q: class must be one of %s", spec, strings.Join(errorClasses, ", "))
+		}
+		switch status {
+		case "ok", "warning", "critical", "unknown", "last":
+		default:
+			return nil, fmt.Errorf("invalid --on-error %q: status must be one of ok, warning, critical, unknown, last", spec)
+		}
+		statuses[class] = status
+	}
+	return statuses, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// onErrorStatus returns the status name for errors of class by --on-error.
+// Invalid --on-error is ignored here, since it is reported by the validation.
+func (opts *logOpts) onErrorStatus(class string) (string, bool) {
+	statuses, err := parseOnError(opts.OnError)
+	if err != nil {
+		return "", false
+	}
+	status, ok := statuses[class]
+	return status, ok
+}
+
+// errorChecker builds the result for err by --on-error. last returns the status of the last run,
+// and it is nil for errors before the state file is known, such as errors in loading --query-definition.
+// "last" results in UNKNOWN then, which the message says.
+func (opts *logOpts) errorChecker(err error, last func() (checkers.Status, bool)) *checkers.Checker {
+	class := classifyError(err)
+	msg := fmt.Sprintf("[%s] %v", class, err)
+	status := checkers.UNKNOWN
+	if name, ok := opts.onErrorStatus(class); ok {
+		var kept bool
+		status, kept = resolveStatus(name, last)
+		if kept {
+			msg += ", keeping the last status"
+		} else if name == "last" && last == nil {
+			msg += ", the last status is not available before the check is set up"
+		}
+	}
+	return checkers.NewChecker(status, msg)
+}
+
+// resolveStatus returns the status by the name of --timeout-status or --on-error.
+// kept is true when the status of the last run is used for "last".
+func resolveStatus(name string, last func() (checkers.Status, bool)) (status checkers.Status, kept bool) {
+	switch name {
+	case "ok":
+		return checkers.OK, false
+	case "warning":
+		return checkers.WARNING, false
+	case "critical":
+		return checkers.CRITICAL, false
+	case "last":
+		if last != nil {
+			if s, ok := last(); ok {
+				return s, true
+			}
+		}
+	}
+	return checkers.UNKNOWN, false
+}
+
+// lastStatus returns the status of the last run in the state
+func (p *awsCWLogsInsightsPlugin) lastStatus() (checkers.Status, bool) {
+	s, err := p.loadState()
+	if err != nil {
+		logger.Warningf("failed to load the last status: %v", err)
+		return checkers.UNKNOWN, false
+	}
+	status, ok := statusByName[s.LastStatus]
+	return status, ok
+}
@@ -0,0 +1,204 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/mackerelio/checkers"
+)
+
+func Test_classifyError(t *testing.T) {
+	httpError := func(code int) error {
+		return &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: code}},
+			Err:      errors.New("unexpected response"),
+		}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "access denied",
+			err:  fmt.Errorf("failed to start query: %w", &smithy.GenericAPIError{Code: "AccessDeniedException"}),
+			want: ErrorClassAuth,
+		},
+		{
+			name: "expired token",
+			err:  &smithy.GenericAPIError{Code: "ExpiredTokenException"},
+			want: ErrorClassAuth,
+		},
+		{
+			name: "forbidden",
+			err:  httpError(http.StatusForbidden),
+			want: ErrorClassAuth,
+		},
+		{
+			name: "throttling",
+			err:  fmt.Errorf("GetQueryResults failed 10 times in a row: %w", &smithy.GenericAPIError{Code: "ThrottlingException"}),
+			want: ErrorClassThrottle,
+		},
+		{
+			name: "too many concurrent queries",
+			err:  &smithy.GenericAPIError{Code: "LimitExceededException"},
+			want: ErrorClassThrottle,
+		},
+		{
+			name: "no query slot",
+			err:  fmt.Errorf("failed to acquire query slot: %w", errNoQuerySlot),
+			want: ErrorClassThrottle,
+		},
+		{
+			name: "query failed",
+			err:  withClass(ErrorClassQuery, errors.New("query was finished with `Failed` status")),
+			want: ErrorClassQuery,
+		},
+		{
+			name: "cancelled",
+			err:  context.Canceled,
+			want: ErrorClassQuery,
+		},
+		{
+			name: "timeout",
+			err:  fmt.Errorf("failed to acquire query slot: %w", context.DeadlineExceeded),
+			want: ErrorClassTimeout,
+		},
+		{
+			name: "state",
+			err:  withClass(ErrorClassState, errors.New("failed to save state file: read-only file system")),
+			want: ErrorClassState,
+		},
+		{
+			name: "malformed query",
+			err:  &smithy.GenericAPIError{Code: "MalformedQueryException"},
+			want: ErrorClassInvalid,
+		},
+		{
+			name: "missing query definition",
+			err:  &queryDefinitionError{msg: "query definition not found"},
+			want: ErrorClassInvalid,
+		},
+		{
+			name: "other",
+			err:  errors.New("connection refused"),
+			want: ErrorClassOther,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseOnError(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "mappings",
+			specs: []string{"auth=critical", "throttle=last", "auth=warning"},
+			want:  map[string]string{"auth": "warning", "throttle": "last"},
+		},
+		{
+			name:    "missing status",
+			specs:   []string{"auth"},
+			wantErr: `invalid --on-error "auth": must be CLASS=STATUS`,
+		},
+		{
+			name:    "unknown class",
+			specs:   []string{"network=ok"},
+			wantErr: `invalid --on-error "network=ok": class must be one of auth, throttle, query, timeout, state, invalid, other`,
+		},
+		{
+			name:    "unknown status",
+			specs:   []string{"auth=fatal"},
+			wantErr: `invalid --on-error "auth=fatal": status must be one of ok, warning, critical, unknown, last`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOnError(tt.specs)
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Fatalf("parseOnError() error = %v, want %q", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOnError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_logOpts_errorChecker(t *testing.T) {
+	lastCritical := func() (checkers.Status, bool) { return checkers.CRITICAL, true }
+	noLast := func() (checkers.Status, bool) { return checkers.UNKNOWN, false }
+	throttled := fmt.Errorf("failed to start query: %w", &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"})
+	tests := []struct {
+		name    string
+		onError []string
+		err     error
+		last    func() (checkers.Status, bool)
+		want    *checkers.Checker
+	}{
+		{
+			name: "default",
+			err:  throttled,
+			last: lastCritical,
+			want: checkers.Unknown("[throttle] failed to start query: api error ThrottlingException: Rate exceeded"),
+		},
+		{
+			name:    "mapped",
+			onError: []string{"throttle=warning"},
+			err:     throttled,
+			last:    lastCritical,
+			want:    checkers.Warning("[throttle] failed to start query: api error ThrottlingException: Rate exceeded"),
+		},
+		{
+			name:    "last status",
+			onError: []string{"throttle=last"},
+			err:     throttled,
+			last:    lastCritical,
+			want:    checkers.Critical("[throttle] failed to start query: api error ThrottlingException: Rate exceeded, keeping the last status"),
+		},
+		{
+			name:    "last status without state",
+			onError: []string{"throttle=last"},
+			err:     throttled,
+			last:    noLast,
+			want:    checkers.Unknown("[throttle] failed to start query: api error ThrottlingException: Rate exceeded"),
+		},
+		{
+			name:    "last status before the setup",
+			onError: []string{"throttle=last"},
+			err:     throttled,
+			want:    checkers.Unknown("[throttle] failed to start query: api error ThrottlingException: Rate exceeded, the last status is not available before the check is set up"),
+		},
+		{
+			name:    "other classes are not mapped",
+			onError: []string{"auth=critical"},
+			err:     errors.New("connection refused"),
+			want:    checkers.Unknown("[other] connection refused"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &logOpts{OnError: tt.onError}
+			if got := opts.errorChecker(tt.err, tt.last); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("logOpts.errorChecker() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
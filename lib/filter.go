@@ -0,0 +1,92 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// validateQuerySource checks that the query is given by exactly one of the options
+func (opts *logOpts) validateQuerySource() error {
+	var sources []string
+	if opts.Filter != "" {
+		sources = append(sources, "--filter")
+	}
+	if opts.FilterFile != "" {
+		sources = append(sources, "--filter-file")
+	}
+	if opts.QueryDefinition != "" {
+		sources = append(sources, "--query-definition")
+	}
+	switch len(sources) {
+	case 0:
+		return errors.New("one of --filter, --filter-file or --query-definition is required")
+	case 1:
+		return nil
+	}
+	return fmt.Errorf("%s cannot be used together", strings.Join(sources, " and "))
+}
+
+// isFilterTemplate reports whether the filter is rendered as a template.
+// --filter is used as is without --var or --env-var, since it was not a template before they were added.
+func (opts *logOpts) isFilterTemplate() bool {
+	return opts.FilterFile != "" || len(opts.Vars) > 0 || len(opts.EnvVars) > 0
+}
+
+// filterTemplateData returns values available in the filter template.
+// Only environment variables named by --env-var are exposed, since the rendered query is sent to AWS and printed.
+// Values of --var override the builtin values.
+func filterTemplateData(vars, envVars []string, region string) (map[string]interface{}, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Warningf("failed to get the hostname: %v", err)
+	}
+	env := map[string]string{}
+	for _, name := range envVars {
+		if name == "" || strings.Contains(name, "=") {
+			return nil, fmt.Errorf("invalid --env-var %q: must be a name of an environment variable", name)
+		}
+		env[name] = os.Getenv(name)
+	}
+	data := map[string]interface{}{
+		"Hostname": hostname,
+		"Region":   region,
+		"Env":      env,
+	}
+	for _, kv := range vars {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid --var %q: must be KEY=VALUE", kv)
+		}
+		data[k] = v
+	}
+	return data, nil
+}
+
+// renderFilter reads --filter-file, and renders the filter with --var into opts.Filter
+func (opts *logOpts) renderFilter(region string) error {
+	text := opts.Filter
+	if opts.FilterFile != "" {
+		b, err := os.ReadFile(opts.FilterFile)
+		if err != nil {
+			return fmt.Errorf("failed to read filter file: %w", err)
+		}
+		text = strings.TrimRight(string(b), "\n")
+	}
+	data, err := filterTemplateData(opts.Vars, opts.EnvVars, region)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New("filter").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse the filter template: %w", err)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return fmt.Errorf("failed to render the filter template: %w", err)
+	}
+	opts.Filter = sb.String()
+	return nil
+}
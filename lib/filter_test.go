@@ -0,0 +1,101 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_logOpts_validateQuerySource(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *logOpts
+		wantErr string
+	}{
+		{
+			name: "filter",
+			opts: &logOpts{Filter: "filter @message like /omg/"},
+		},
+		{
+			name: "filter file",
+			opts: &logOpts{FilterFile: "query.txt"},
+		},
+		{
+			name:    "none",
+			opts:    &logOpts{},
+			wantErr: "one of --filter, --filter-file or --query-definition is required",
+		},
+		{
+			name:    "filter and filter file",
+			opts:    &logOpts{Filter: "filter @message like /omg/", FilterFile: "query.txt"},
+			wantErr: "--filter and --filter-file cannot be used together",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.validateQuerySource()
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("logOpts.validateQuerySource() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_logOpts_renderFilter(t *testing.T) {
+	t.Setenv("CHECK_TEST_ENV", "staging")
+	t.Setenv("CHECK_TEST_SECRET", "secret")
+	hostname, _ := os.Hostname()
+	file := filepath.Join(t.TempDir(), "query.txt")
+	content := "filter service = \"{{.service}}\"\n| filter env = \"{{.Env.CHECK_TEST_ENV}}\" and region = \"{{.Region}}\"\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    *logOpts
+		want    string
+		wantErr string
+	}{
+		{
+			name: "filter file",
+			opts: &logOpts{FilterFile: file, Vars: []string{"service=api"}, EnvVars: []string{"CHECK_TEST_ENV"}},
+			want: "filter service = \"api\"\n| filter env = \"staging\" and region = \"ap-northeast-1\"",
+		},
+		{
+			name: "filter with vars",
+			opts: &logOpts{Filter: `filter @logStream = "{{.Hostname}}" and level = "{{.level}}"`, Vars: []string{"level=error=fatal"}},
+			want: `filter @logStream = "` + hostname + `" and level = "error=fatal"`,
+		},
+		{
+			name: "vars override builtin values",
+			opts: &logOpts{Filter: `filter region = "{{.Region}}"`, Vars: []string{"Region=us-east-1"}},
+			want: `filter region = "us-east-1"`,
+		},
+		{
+			name:    "missing var",
+			opts:    &logOpts{FilterFile: file},
+			wantErr: `failed to render the filter template: template: filter:1:20: executing "filter" at <.service>: map has no entry for key "service"`,
+		},
+		{
+			name:    "environment variables are not exposed without env-var",
+			opts:    &logOpts{Filter: `filter key = "{{.Env.CHECK_TEST_SECRET}}"`, EnvVars: []string{"CHECK_TEST_ENV"}},
+			wantErr: `failed to render the filter template: template: filter:1:20: executing "filter" at <.Env.CHECK_TEST_SECRET>: map has no entry for key "CHECK_TEST_SECRET"`,
+		},
+		{
+			name:    "invalid var",
+			opts:    &logOpts{Filter: "filter level = 'error'", Vars: []string{"level"}},
+			wantErr: `invalid --var "level": must be KEY=VALUE`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.renderFilter("ap-northeast-1")
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Fatalf("logOpts.renderFilter() error = %v, want %q", err, tt.wantErr)
+			}
+			if err == nil && tt.opts.Filter != tt.want {
+				t.Errorf("logOpts.renderFilter() Filter = %q, want %q", tt.opts.Filter, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// messageMasks mask variable parts of messages to group similar messages
+var messageMasks = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`), "<timestamp>"},
+	{regexp.MustCompile(`\b\d{2}:\d{2}:\d{2}(?:[.,]\d+)?\b`), "<timestamp>"},
+	{regexp.MustCompile(`\b(?:0x[0-9a-fA-F]+|[0-9a-fA-F]*[0-9][0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*|[0-9a-fA-F]*[a-fA-F][0-9a-fA-F]*[0-9][0-9a-fA-F]*)\b`), "<hex>"},
+	{regexp.MustCompile(`\d+(?:\.\d+)?`), "<num>"},
+}
+
+// normalizeMessage masks UUIDs, timestamps, hex strings and numbers in the message
+func normalizeMessage(m string) string {
+	for _, mask := range messageMasks {
+		m = mask.re.ReplaceAllString(m, mask.replacement)
+	}
+	return m
+}
+
+// validateGrouping checks --group-server-side, which only works with --group-messages
+func (opts *logOpts) validateGrouping() error {
+	if opts.GroupServerSide && !opts.GroupMessages {
+		return errors.New("--group-server-side requires --group-messages")
+	}
+	return nil
+}
+
+// messageGroup is a group of similar messages
+type messageGroup struct {
+	// index is the index of the first message in the group
+	index int
+	count int
+}
+
+// groupMessages groups messages which are the same after normalization.
+// Groups are sorted by their counts, and then by their first appearances.
+func groupMessages(messages []string) []messageGroup {
+	var groups []messageGroup
+	byKey := make(map[string]int)
+	for i, m := range messages {
+		key := normalizeMessage(m)
+		if j, ok := byKey[key]; ok {
+			groups[j].count++
+			continue
+		}
+		byKey[key] = len(groups)
+		groups = append(groups, messageGroup{index: i, count: 1})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].count > groups[j].count
+	})
+	return groups
+}
+
+// patternLines returns lines for rows returned by the pattern command
+func (p *awsCWLogsInsightsPlugin) patternLines(res *ParsedQueryResults) []returnedLine {
+	lines := make([]returnedLine, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		count, err := strconv.Atoi(row.Field("@sampleCount"))
+		if err != nil {
+			logger.Warningf("unexpected @sampleCount of pattern: %v", err)
+			continue
+		}
+		lines = append(lines, returnedLine{
+			text:  truncateUTF8(tabReplacer.Replace(row.Field("@pattern")), p.MessageMaxLength),
+			count: count,
+		})
+	}
+	return withCounts(lines)
+}
+
+// withCounts prefixes counts to lines, padded to the same width
+func withCounts(lines []returnedLine) []returnedLine {
+	width := 0
+	for _, l := range lines {
+		if w := len(strconv.Itoa(l.count)); w > width {
+			width = w
+		}
+	}
+	for i, l := range lines {
+		lines[i].text = fmt.Sprintf("×%-*d %s", width, l.count, l.text)
+	}
+	return lines
+}
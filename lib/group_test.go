@@ -0,0 +1,145 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func Test_normalizeMessage(t *testing.T) {
+	tests := []struct {
+		m    string
+		want string
+	}{
+		{
+			m:    "request 3f2b8c1e-5d4a-4c2b-9e1f-0a1b2c3d4e5f failed after 120ms",
+			want: "request <uuid> failed after <num>ms",
+		},
+		{
+			m:    "2020-10-12T03:00:00.123Z ERROR connection reset at 10:23:45",
+			want: "<timestamp> ERROR connection reset at <timestamp>",
+		},
+		{
+			m:    "trace=5f8a1b2c3d4e object 0xdeadbeef not found",
+			want: "trace=<hex> object <hex> not found",
+		},
+		{
+			m:    "user 42 exceeded rate limit of 1.5 req/s",
+			want: "user <num> exceeded rate limit of <num> req/s",
+		},
+		{
+			m:    "nothing variable here",
+			want: "nothing variable here",
+		},
+	}
+	for _, tt := range tests {
+		if got := normalizeMessage(tt.m); got != tt.want {
+			t.Errorf("normalizeMessage(%q) = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func Test_groupMessages(t *testing.T) {
+	messages := []string{
+		"timeout id=1",
+		"panic: nil pointer",
+		"timeout id=2",
+		"timeout id=3",
+		"panic: nil pointer",
+		"disk full",
+	}
+	want := []messageGroup{
+		{index: 0, count: 3},
+		{index: 1, count: 2},
+		{index: 5, count: 1},
+	}
+	if got := groupMessages(messages); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupMessages() = %v, want %v", got, want)
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_appendMessages_withGroupMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		logOpts *logOpts
+		res     *ParsedQueryResults
+		want    string
+	}{
+		{
+			name:    "group messages",
+			logOpts: &logOpts{GroupMessages: true},
+			res: &ParsedQueryResults{
+				MatchedCount: 25,
+				ReturnedMessages: []string{
+					"timeout request_id=101", "panic: nil pointer", "timeout request_id=102",
+					"timeout request_id=103", "panic: nil pointer",
+				},
+			},
+			want: "25 > 1 messages\n×3 timeout request_id=101\n×2 panic: nil pointer\n(20 more)",
+		},
+		{
+			name:    "group rows with fields",
+			logOpts: &logOpts{GroupMessages: true, ReturnFields: []string{"@logStream"}},
+			res: &ParsedQueryResults{
+				MatchedCount: 3,
+				Rows: []ResultRow{
+					{{Name: "@logStream", Value: "app-1"}, {Name: "@message", Value: "timeout request_id=101"}},
+					{{Name: "@logStream", Value: "app-2"}, {Name: "@message", Value: "disk full"}},
+					{{Name: "@logStream", Value: "app-1"}, {Name: "@message", Value: "timeout request_id=102"}},
+				},
+			},
+			want: "3 > 1 messages\n×2 app-1  timeout request_id=101\n×1 app-2  disk full",
+		},
+		{
+			name:    "server side patterns",
+			logOpts: &logOpts{GroupMessages: true, GroupServerSide: true},
+			res: &ParsedQueryResults{
+				MatchedCount: 1520,
+				Rows: []ResultRow{
+					{{Name: "@pattern", Value: "timeout request_id=<*>"}, {Name: "@sampleCount", Value: "1200"}},
+					{{Name: "@pattern", Value: "panic: <*>"}, {Name: "@sampleCount", Value: "300"}},
+				},
+			},
+			want: "1520 > 1 messages\n×1200 timeout request_id=<*>\n×300  panic: <*>\n(20 more)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsCWLogsInsightsPlugin{logOpts: tt.logOpts}
+			summary := fmt.Sprintf("%d > 1 messages", tt.res.MatchedCount)
+			if got := p.appendMessages(summary, tt.res); got != tt.want {
+				t.Errorf("awsCWLogsInsightsPlugin.appendMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_logOpts_validateGrouping(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *logOpts
+		wantErr string
+	}{
+		{
+			name: "disabled",
+			opts: &logOpts{},
+		},
+		{
+			name: "server side grouping",
+			opts: &logOpts{GroupMessages: true, GroupServerSide: true},
+		},
+		{
+			name:    "server side without group messages",
+			opts:    &logOpts{GroupServerSide: true},
+			wantErr: "--group-server-side requires --group-messages",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.validateGrouping()
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("logOpts.validateGrouping() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mackerelio/checkers"
+)
+
+// minHistorySize is the number of runs kept in the state at least
+const minHistorySize = 10
+
+// runRecord is the result of a run kept in the state
+type runRecord struct {
+	EndTime int64
+	// Status is the status by the thresholds, before --min-consecutive and --recover-after are applied
+	Status       string
+	MatchedCount int
+}
+
+func (opts *logOpts) historySize() int {
+	n := minHistorySize
+	if opts.MinConsecutive > n {
+		n = opts.MinConsecutive
+	}
+	if opts.RecoverAfter > n {
+		n = opts.RecoverAfter
+	}
+	return n
+}
+
+// validateHysteresis checks --min-consecutive and --recover-after
+func (opts *logOpts) validateHysteresis() error {
+	if opts.MinConsecutive < 1 {
+		return errors.New("--min-consecutive must be 1 or more")
+	}
+	if opts.RecoverAfter < 1 {
+		return errors.New("--recover-after must be 1 or more")
+	}
+	return nil
+}
+
+// streak counts the runs in a row from the newest one which satisfy f
+func streak(history []runRecord, f func(checkers.Status) bool) int {
+	n := 0
+	for i := len(history) - 1; i >= 0; i-- {
+		if !f(statusByName[history[i].Status]) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func breached(s checkers.Status) bool { return s != checkers.OK }
+
+func clean(s checkers.Status) bool { return s == checkers.OK }
+
+// hysteresis decides the status to report from the status by the thresholds, the past runs and the last reported status.
+// It returns a note about the streak to show in the message.
+func (p *awsCWLogsInsightsPlugin) hysteresis(status checkers.Status, history []runRecord, last checkers.Status) (checkers.Status, string) {
+	if status != checkers.OK {
+		n := 1 + streak(history, breached)
+		// an alert which is recovering escalates again at once
+		if n >= p.MinConsecutive || last != checkers.OK {
+			if p.MinConsecutive > 1 {
+				return status, fmt.Sprintf("%d breaches in a row", n)
+			}
+			return status, ""
+		}
+		return checkers.OK, fmt.Sprintf("%d/%d breaches in a row", n, p.MinConsecutive)
+	}
+	if last != checkers.OK {
+		n := 1 + streak(history, clean)
+		if n < p.RecoverAfter {
+			return last, fmt.Sprintf("recovering, %d/%d clean runs", n, p.RecoverAfter)
+		}
+	}
+	return checkers.OK, ""
+}
+
+// evaluateWithHistory builds the result of the run with the anomaly mode, the comparison with c if any,
+// --min-consecutive and --recover-after, and records it in the state
+func (p *awsCWLogsInsightsPlugin) evaluateWithHistory(res *ParsedQueryResults, c *comparison) *checkers.Checker {
+	status, summary := p.evaluate(res)
+	if c != nil {
+		status, summary = p.applyComparison(status, summary, res, c)
+	}
+	if p.anomalyEnabled() {
+		status, summary = p.evaluateAnomaly(status, summary, res)
+	}
+	return p.applyHistory(status, summary, res)
+}
+
+// applyHistory applies --min-consecutive and --recover-after to status by the thresholds,
+// and records the run in the state. The window of the next run in the state is left as it is.
+func (p *awsCWLogsInsightsPlugin) applyHistory(status checkers.Status, summary string, res *ParsedQueryResults) *checkers.Checker {
+	s, err := p.loadState()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warningf("failed to load the history: %v", err)
+		}
+		s = &logState{}
+	}
+	last, ok := statusByName[s.LastStatus]
+	if !ok {
+		last = checkers.OK
+	}
+	reported, note := p.hysteresis(status, s.History, last)
+	if note != "" {
+		summary += " (" + note + ")"
+	}
+	ckr := p.newChecker(reported, summary, res)
+
+	s.LastStatus = reported.String()
+	s.History = append(s.History, runRecord{EndTime: res.EndTime.Unix(), Status: status.String(), MatchedCount: res.MatchedCount})
+	if n := p.historySize(); len(s.History) > n {
+		s.History = s.History[len(s.History)-n:]
+	}
+	if err := p.saveState(s); err != nil {
+		logger.Warningf("failed to save the last status: %v", err)
+	}
+	return ckr
+}
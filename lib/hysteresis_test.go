@@ -0,0 +1,138 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+func Test_awsCWLogsInsightsPlugin_hysteresis(t *testing.T) {
+	records := func(statuses ...checkers.Status) []runRecord {
+		var rs []runRecord
+		for _, s := range statuses {
+			rs = append(rs, runRecord{Status: s.String()})
+		}
+		return rs
+	}
+	tests := []struct {
+		name           string
+		minConsecutive int
+		recoverAfter   int
+		status         checkers.Status
+		history        []runRecord
+		last           checkers.Status
+		want           checkers.Status
+		wantNote       string
+	}{
+		{
+			name:           "default",
+			minConsecutive: 1,
+			recoverAfter:   1,
+			status:         checkers.CRITICAL,
+			want:           checkers.CRITICAL,
+		},
+		{
+			name:           "first breach",
+			minConsecutive: 3,
+			recoverAfter:   1,
+			status:         checkers.WARNING,
+			history:        records(checkers.WARNING, checkers.OK),
+			want:           checkers.OK,
+			wantNote:       "1/3 breaches in a row",
+		},
+		{
+			name:           "enough breaches",
+			minConsecutive: 3,
+			recoverAfter:   1,
+			status:         checkers.CRITICAL,
+			history:        records(checkers.OK, checkers.WARNING, checkers.CRITICAL),
+			want:           checkers.CRITICAL,
+			wantNote:       "3 breaches in a row",
+		},
+		{
+			name:           "recovering",
+			minConsecutive: 1,
+			recoverAfter:   3,
+			status:         checkers.OK,
+			history:        records(checkers.CRITICAL, checkers.OK),
+			last:           checkers.CRITICAL,
+			want:           checkers.CRITICAL,
+			wantNote:       "recovering, 2/3 clean runs",
+		},
+		{
+			name:           "recovered",
+			minConsecutive: 1,
+			recoverAfter:   3,
+			status:         checkers.OK,
+			history:        records(checkers.CRITICAL, checkers.OK, checkers.OK),
+			last:           checkers.CRITICAL,
+			want:           checkers.OK,
+		},
+		{
+			name:           "breach while recovering",
+			minConsecutive: 3,
+			recoverAfter:   3,
+			status:         checkers.WARNING,
+			history:        records(checkers.CRITICAL, checkers.CRITICAL, checkers.CRITICAL, checkers.OK),
+			last:           checkers.CRITICAL,
+			want:           checkers.WARNING,
+			wantNote:       "1 breaches in a row",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsCWLogsInsightsPlugin{logOpts: &logOpts{MinConsecutive: tt.minConsecutive, RecoverAfter: tt.recoverAfter}}
+			got, note := p.hysteresis(tt.status, tt.history, tt.last)
+			if got != tt.want || note != tt.wantNote {
+				t.Errorf("awsCWLogsInsightsPlugin.hysteresis() = %v, %q, want %v, %q", got, note, tt.want, tt.wantNote)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_evaluateWithHistory(t *testing.T) {
+	p := &awsCWLogsInsightsPlugin{
+		StateFile: filepath.Join(t.TempDir(), "state.json"),
+		logOpts:   &logOpts{WarningOver: 0, CriticalOver: 10, MinConsecutive: 2, RecoverAfter: 2},
+	}
+	end := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	runs := []struct {
+		count       int
+		wantStatus  checkers.Status
+		wantMessage string
+	}{
+		{0, checkers.OK, "0 messages"},
+		{1, checkers.OK, "1 > 0 messages (1/2 breaches in a row)"},
+		{11, checkers.CRITICAL, "11 > 10 messages (2 breaches in a row)"},
+		{0, checkers.CRITICAL, "0 messages (recovering, 1/2 clean runs)"},
+		{0, checkers.OK, "0 messages"},
+	}
+	for i, run := range runs {
+		end = end.Add(time.Minute)
+		ckr := p.evaluateWithHistory(&ParsedQueryResults{Finished: true, MatchedCount: run.count, EndTime: end}, nil)
+		if ckr.Status != run.wantStatus || ckr.Message != run.wantMessage {
+			t.Errorf("run %d: evaluateWithHistory() = %v %q, want %v %q", i, ckr.Status, ckr.Message, run.wantStatus, run.wantMessage)
+		}
+	}
+
+	s, err := p.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LastStatus != "OK" || len(s.History) != len(runs) {
+		t.Errorf("state = %+v", s)
+	}
+	if last := s.History[len(s.History)-1]; last.EndTime != end.Unix() || last.Status != "OK" {
+		t.Errorf("last record = %+v", last)
+	}
+
+	// the history is trimmed
+	for i := 0; i < minHistorySize; i++ {
+		p.evaluateWithHistory(&ParsedQueryResults{Finished: true}, nil)
+	}
+	if s, _ := p.loadState(); len(s.History) != minHistorySize {
+		t.Errorf("history has %d records, want %d", len(s.History), minHistorySize)
+	}
+}
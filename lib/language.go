@@ -0,0 +1,82 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// queryLanguages maps --query-language to QueryLanguage of StartQuery.
+// cwli is not in it, so that StartQuery is called without QueryLanguage as before.
+var queryLanguages = map[string]types.QueryLanguage{
+	"ppl": types.QueryLanguagePpl,
+	"sql": types.QueryLanguageSql,
+}
+
+// countQueryPattern matches SQL queries which return the count as a single row
+var countQueryPattern = regexp.MustCompile(`(?i)^\s*select\s+count\s*\(\s*\*\s*\)`)
+
+// validateLanguage checks the options depending on --query-language
+func (opts *logOpts) validateLanguage() error {
+	if opts.QueryLanguage == "sql" {
+		if len(opts.LogGroupNames) > 0 {
+			return errors.New("--log-group-name cannot be used with --query-language=sql. Specify log groups in the FROM clause")
+		}
+		if len(opts.ReturnFields) > 0 {
+			return errors.New("--return-fields cannot be used with --query-language=sql. Select fields in the query")
+		}
+	} else if len(opts.LogGroupNames) == 0 {
+		return errors.New("the required flag `--log-group-name' was not specified")
+	}
+	if opts.GroupServerSide && opts.isOpenSearchLanguage() {
+		return errors.New("--group-server-side can be used only with --query-language=cwli")
+	}
+	return nil
+}
+
+// isOpenSearchLanguage reports whether the query is written in OpenSearch PPL or SQL
+func (opts *logOpts) isOpenSearchLanguage() bool {
+	_, ok := queryLanguages[opts.QueryLanguage]
+	return ok
+}
+
+// fieldsCommand returns the command to append to the query to return fields
+func (opts *logOpts) fieldsCommand(fields []string) string {
+	if opts.QueryLanguage == "ppl" {
+		quoted := make([]string, len(fields))
+		for i, f := range fields {
+			quoted[i] = "`" + f + "`"
+		}
+		fields = quoted
+	}
+	return " | fields " + strings.Join(fields, ", ")
+}
+
+// parseQueryResults parses the output of GetQueryResults.
+// For SQL COUNT(*) queries, the matched count is read from the returned row instead of the statistics.
+func (p *awsCWLogsInsightsPlugin) parseQueryResults(out *cloudwatchlogs.GetQueryResultsOutput) (*ParsedQueryResults, error) {
+	res, err := parseResult(out)
+	if err != nil {
+		return nil, err
+	}
+	if p.QueryLanguage != "sql" || !countQueryPattern.MatchString(p.Filter) || len(res.Rows) == 0 {
+		return res, nil
+	}
+	for _, f := range res.Rows[0] {
+		if f.Name == "@ptr" {
+			continue
+		}
+		n, err := strconv.ParseFloat(f.Value, 64)
+		if err != nil {
+			logger.Warningf("failed to read the count from %s of the result: %v", f.Name, err)
+			break
+		}
+		res.MatchedCount = int(n)
+		break
+	}
+	return res, nil
+}
@@ -0,0 +1,113 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+func Test_logOpts_validateLanguage(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *logOpts
+		wantErr string
+	}{
+		{
+			name: "cwli",
+			opts: &logOpts{QueryLanguage: "cwli", LogGroupNames: []string{"/log/foo"}},
+		},
+		{
+			name:    "cwli without log groups",
+			opts:    &logOpts{QueryLanguage: "cwli"},
+			wantErr: "the required flag `--log-group-name' was not specified",
+		},
+		{
+			name:    "ppl with GroupServerSide",
+			opts:    &logOpts{QueryLanguage: "ppl", LogGroupNames: []string{"/log/foo"}, GroupServerSide: true},
+			wantErr: "--group-server-side can be used only with --query-language=cwli",
+		},
+		{
+			name: "sql",
+			opts: &logOpts{QueryLanguage: "sql"},
+		},
+		{
+			name:    "sql with log groups",
+			opts:    &logOpts{QueryLanguage: "sql", LogGroupNames: []string{"/log/foo"}},
+			wantErr: "--log-group-name cannot be used with --query-language=sql. Specify log groups in the FROM clause",
+		},
+		{
+			name:    "sql with ReturnFields",
+			opts:    &logOpts{QueryLanguage: "sql", ReturnFields: []string{"@timestamp"}},
+			wantErr: "--return-fields cannot be used with --query-language=sql. Select fields in the query",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.validateLanguage()
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("logOpts.validateLanguage() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_parseQueryResults(t *testing.T) {
+	countRows := [][]types.ResultField{
+		{
+			{Field: aws.String("count(*)"), Value: aws.String("42")},
+			{Field: aws.String("@ptr"), Value: aws.String("xxx")},
+		},
+	}
+	tests := []struct {
+		name          string
+		logOpts       *logOpts
+		results       [][]types.ResultField
+		wantMatched   int
+		wantRowsCount int
+	}{
+		{
+			name:          "SQL COUNT(*)",
+			logOpts:       &logOpts{QueryLanguage: "sql", Filter: "SELECT COUNT(*) FROM `logGroups(logGroupIdentifier: ['/log/foo'])` WHERE level = 'error'"},
+			results:       countRows,
+			wantMatched:   42,
+			wantRowsCount: 1,
+		},
+		{
+			name:          "SQL without COUNT(*)",
+			logOpts:       &logOpts{QueryLanguage: "sql", Filter: "SELECT level FROM `logGroups(logGroupIdentifier: ['/log/foo'])`"},
+			results:       countRows,
+			wantMatched:   5,
+			wantRowsCount: 1,
+		},
+		{
+			name:        "SQL COUNT(*) without rows",
+			logOpts:     &logOpts{QueryLanguage: "sql", Filter: "select count(*) from `logGroups(logGroupIdentifier: ['/log/foo'])`"},
+			wantMatched: 5,
+		},
+		{
+			name:          "CWLI",
+			logOpts:       &logOpts{Filter: "SELECT COUNT(*)"},
+			results:       countRows,
+			wantMatched:   5,
+			wantRowsCount: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsCWLogsInsightsPlugin{logOpts: tt.logOpts}
+			got, err := p.parseQueryResults(&cloudwatchlogs.GetQueryResultsOutput{
+				Status:     types.QueryStatusComplete,
+				Statistics: &types.QueryStatistics{RecordsMatched: 5},
+				Results:    tt.results,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.MatchedCount != tt.wantMatched || len(got.Rows) != tt.wantRowsCount {
+				t.Errorf("awsCWLogsInsightsPlugin.parseQueryResults() MatchedCount = %d, rows = %d, want %d, %d", got.MatchedCount, len(got.Rows), tt.wantMatched, tt.wantRowsCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mackerelio/checkers"
+)
+
+const (
+	defaultReturnLimit = 10
+	// maxReturnLimit is the maximum limit of StartQuery
+	maxReturnLimit = 10000
+	ellipsis       = "..."
+)
+
+// returnLimit returns the number of log messages to be returned by the query
+func (opts *logOpts) returnLimit() int {
+	if opts.ReturnLimit <= 0 {
+		return defaultReturnLimit
+	}
+	if opts.ReturnLimit > maxReturnLimit {
+		return maxReturnLimit
+	}
+	return opts.ReturnLimit
+}
+
+// appendMessages appends returned messages to the first line of the check message.
+// Each message is truncated to --message-max-length, and messages are dropped
+// to keep the whole check message within --output-max-bytes.
+// The count of messages which are not shown is appended as a "(N more)" line.
+func (p *awsCWLogsInsightsPlugin) appendMessages(msg string, res *ParsedQueryResults) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	lines := p.returnedLines(res)
+	size, count := b.Len(), 0
+	for _, l := range lines {
+		size += len("\n") + len(l.text)
+		count += l.count
+	}
+	// reserve room for the summary line of the largest count only when lines are dropped
+	reserved := 0
+	if count < res.MatchedCount || (p.OutputMaxBytes > 0 && size > p.OutputMaxBytes) {
+		reserved = len(moreLine(res.MatchedCount))
+	}
+	shown := 0
+	for _, l := range lines {
+		line := "\n" + l.text
+		if p.OutputMaxBytes > 0 && b.Len()+len(line)+reserved > p.OutputMaxBytes {
+			break
+		}
+		b.WriteString(line)
+		shown += l.count
+	}
+	if more := res.MatchedCount - shown; more > 0 {
+		b.WriteString(moreLine(more))
+	}
+	return truncateUTF8(b.String(), p.OutputMaxBytes)
+}
+
+// returnFields returns fields specified by --return-fields, other than @message
+func (opts *logOpts) returnFields() []string {
+	var fields []string
+	for _, v := range opts.ReturnFields {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" && f != "@message" {
+				fields = append(fields, f)
+			}
+		}
+	}
+	return fields
+}
+
+// returnedLine is a line to output for returned rows
+type returnedLine struct {
+	text string
+	// count is the number of log events represented by the line
+	count int
+}
+
+// returnedLines returns lines to output for returned rows.
+// With --return-fields, the fields are aligned in columns followed by @message,
+// and tabs and newlines in values are replaced with spaces to keep the columns.
+// With --group-messages, similar messages are output once with their counts.
+func (p *awsCWLogsInsightsPlugin) returnedLines(res *ParsedQueryResults) []returnedLine {
+	if p.GroupMessages && p.GroupServerSide {
+		return p.patternLines(res)
+	}
+
+	var messages, texts []string
+	if fields := p.returnFields(); len(fields) == 0 {
+		for _, m := range res.ReturnedMessages {
+			messages = append(messages, m)
+			texts = append(texts, truncateUTF8(m, p.MessageMaxLength))
+		}
+	} else if len(res.Rows) > 0 {
+		var buf bytes.Buffer
+		w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		for _, row := range res.Rows {
+			cells := make([]string, 0, len(fields)+1)
+			for _, f := range fields {
+				cells = append(cells, tabReplacer.Replace(row.Field(f)))
+			}
+			cells = append(cells, truncateUTF8(tabReplacer.Replace(row.Field("@message")), p.MessageMaxLength))
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+			messages = append(messages, row.Field("@message"))
+		}
+		w.Flush()
+		texts = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	}
+
+	if !p.GroupMessages {
+		lines := make([]returnedLine, 0, len(texts))
+		for _, t := range texts {
+			lines = append(lines, returnedLine{text: t, count: 1})
+		}
+		return lines
+	}
+	groups := groupMessages(messages)
+	lines := make([]returnedLine, 0, len(groups))
+	for _, g := range groups {
+		lines = append(lines, returnedLine{text: texts[g.index], count: g.count})
+	}
+	return withCounts(lines)
+}
+
+var tabReplacer = strings.NewReplacer("\t", " ", "\n", " ")
+
+func moreLine(n int) string {
+	return fmt.Sprintf("\n(%d more)", n)
+}
+
+// truncateUTF8 truncates s to at most n bytes on a UTF-8 boundary, marking it with an ellipsis.
+// It returns s as is when n <= 0.
+func truncateUTF8(s string, n int) string {
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	if n <= len(ellipsis) {
+		return ellipsis[:n]
+	}
+	cut := n - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + ellipsis
+}
+
+// messageTemplateData is passed to --message-template
+type messageTemplateData struct {
+	// Status is one of OK, WARNING and CRITICAL
+	Status string
+	// Summary is the first line of the default message, e.g. "5 > 4 messages"
+	Summary       string
+	MatchedCount  int
+	WarningOver   int
+	CriticalOver  int
+	StartTime     time.Time
+	EndTime       time.Time
+	LogGroupNames []string
+	Statistics    QueryStatistics
+	Rows          []ResultRow
+	Messages      []string
+	Partial       bool
+	// ConsoleURL is a URL of CloudWatch Logs Insights console, available with --console-url
+	ConsoleURL string
+}
+
+var messageTemplateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"truncate": func(n int, s string) string {
+		return truncateUTF8(s, n)
+	},
+}
+
+// parseMessageTemplate parses --message-template or --message-template-file.
+// It returns nil if neither is specified.
+func (opts *logOpts) parseMessageTemplate() (*template.Template, error) {
+	text := opts.MessageTemplate
+	if opts.MessageTemplateFile != "" {
+		if text != "" {
+			return nil, errors.New("--message-template and --message-template-file are exclusive")
+		}
+		b, err := os.ReadFile(opts.MessageTemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message template: %w", err)
+		}
+		text = strings.TrimRight(string(b), "\n")
+	}
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("message").Funcs(messageTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderMessage builds the check message by the message template
+func (p *awsCWLogsInsightsPlugin) renderMessage(status checkers.Status, summary, consoleURL string, res *ParsedQueryResults) (string, error) {
+	data := &messageTemplateData{
+		Status:        status.String(),
+		Summary:       summary,
+		MatchedCount:  res.MatchedCount,
+		WarningOver:   p.WarningOver,
+		CriticalOver:  p.CriticalOver,
+		StartTime:     res.StartTime,
+		EndTime:       res.EndTime,
+		LogGroupNames: p.LogGroupNames,
+		Statistics:    res.Statistics,
+		Rows:          res.Rows,
+		Messages:      res.ReturnedMessages,
+		Partial:       res.Partial,
+		ConsoleURL:    consoleURL,
+	}
+	var buf bytes.Buffer
+	if err := p.messageTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return truncateUTF8(buf.String(), p.OutputMaxBytes), nil
+}
@@ -0,0 +1,161 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+func Test_truncateUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{name: "no limit", s: "omg something happend", n: 0, want: "omg something happend"},
+		{name: "short enough", s: "omg", n: 3, want: "omg"},
+		{name: "ascii", s: "omg something happend", n: 10, want: "omg som..."},
+		{name: "multibyte boundary", s: "エラーが発生しました", n: 12, want: "エラー..."},
+		{name: "inside multibyte", s: "エラーが発生しました", n: 11, want: "エラ..."},
+		{name: "smaller than ellipsis", s: "omg something happend", n: 2, want: ".."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateUTF8(tt.s, tt.n); got != tt.want {
+				t.Errorf("truncateUTF8() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_appendMessages(t *testing.T) {
+	res := &ParsedQueryResults{
+		MatchedCount:     25,
+		ReturnedMessages: []string{"first message", "second message", "third message"},
+	}
+	tests := []struct {
+		name    string
+		logOpts *logOpts
+		res     *ParsedQueryResults
+		want    string
+	}{
+		{
+			name:    "all messages",
+			logOpts: &logOpts{},
+			res:     &ParsedQueryResults{MatchedCount: 2, ReturnedMessages: []string{"first message", "second message"}},
+			want:    "2 > 1 messages\nfirst message\nsecond message",
+		},
+		{
+			name:    "more messages are matched",
+			logOpts: &logOpts{},
+			res:     res,
+			want:    "2 > 1 messages\nfirst message\nsecond message\nthird message\n(22 more)",
+		},
+		{
+			name:    "truncate each message",
+			logOpts: &logOpts{MessageMaxLength: 8},
+			res:     res,
+			want:    "2 > 1 messages\nfirst...\nsecon...\nthird...\n(22 more)",
+		},
+		{
+			name:    "drop messages to fit the output",
+			logOpts: &logOpts{OutputMaxBytes: 53},
+			res:     res,
+			want:    "2 > 1 messages\nfirst message\nsecond message\n(23 more)",
+		},
+		{
+			name:    "all messages just fit the output",
+			logOpts: &logOpts{OutputMaxBytes: 43},
+			res:     &ParsedQueryResults{MatchedCount: 2, ReturnedMessages: []string{"first message", "second message"}},
+			want:    "2 > 1 messages\nfirst message\nsecond message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &awsCWLogsInsightsPlugin{logOpts: tt.logOpts}
+			got := p.appendMessages("2 > 1 messages", tt.res)
+			if got != tt.want {
+				t.Errorf("awsCWLogsInsightsPlugin.appendMessages() = %q, want %q", got, tt.want)
+			}
+			if max := tt.logOpts.OutputMaxBytes; max > 0 && len(got) > max {
+				t.Errorf("awsCWLogsInsightsPlugin.appendMessages() returns %d bytes, want <= %d", len(got), max)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_buildChecker_withMessageTemplate(t *testing.T) {
+	res := &ParsedQueryResults{
+		MatchedCount:     5,
+		ReturnedMessages: []string{"omg first", "omg second"},
+		Rows: []ResultRow{
+			{{Name: "@timestamp", Value: "2020-10-12 03:00:01.000"}, {Name: "@message", Value: "omg first"}},
+			{{Name: "@timestamp", Value: "2020-10-12 03:00:02.000"}, {Name: "@message", Value: "omg second"}},
+		},
+		Statistics: QueryStatistics{RecordsMatched: 5, RecordsScanned: 120, BytesScanned: 4096},
+		StartTime:  time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC),
+		EndTime:    time.Date(2020, 10, 12, 3, 1, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     *checkers.Checker
+	}{
+		{
+			name:     "summary and runbook",
+			template: `[{{.Status}}] {{.Summary}} in {{join .LogGroupNames ","}} ({{.StartTime.Format "15:04"}}-{{.EndTime.Format "15:04"}}) runbook: https://example.com/runbook`,
+			want:     checkers.Critical("[CRITICAL] 5 > 4 messages in /log/foo,/log/baz (03:00-03:01) runbook: https://example.com/runbook"),
+		},
+		{
+			name:     "rows and statistics",
+			template: `{{.MatchedCount}}/{{.Statistics.RecordsScanned}} over {{.CriticalOver}}{{range .Rows}}` + "\n" + `{{.Field "@timestamp"}} {{.Field "@message" | truncate 6}}{{end}}`,
+			want:     checkers.Critical("5/120 over 4\n2020-10-12 03:00:01.000 omg...\n2020-10-12 03:00:02.000 omg..."),
+		},
+		{
+			name:     "falls back to the default message on error",
+			template: `{{.NoSuchField}}`,
+			want:     checkers.Critical("5 > 4 messages (failed to render the message template: template: message:1:2: executing \"message\" at <.NoSuchField>: can't evaluate field NoSuchField in type *checkawscloudwatchlogsinsights.messageTemplateData)"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &logOpts{
+				LogGroupNames:   []string{"/log/foo", "/log/baz"},
+				CriticalOver:    4,
+				WarningOver:     2,
+				MessageTemplate: tt.template,
+			}
+			tmpl, err := opts.parseMessageTemplate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &awsCWLogsInsightsPlugin{logOpts: opts, messageTemplate: tmpl}
+			if got := p.buildChecker(res); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("awsCWLogsInsightsPlugin.buildChecker() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_appendMessages_withReturnFields(t *testing.T) {
+	res := &ParsedQueryResults{
+		MatchedCount: 3,
+		Rows: []ResultRow{
+			{{Name: "@timestamp", Value: "2020-10-12 03:00:01.000"}, {Name: "@logStream", Value: "app"}, {Name: "level", Value: "error"}, {Name: "@message", Value: "omg first"}},
+			{{Name: "@timestamp", Value: "2020-10-12 03:00:02.000"}, {Name: "@logStream", Value: "app-canary"}, {Name: "@message", Value: "omg\tsecond"}},
+		},
+	}
+	p := &awsCWLogsInsightsPlugin{logOpts: &logOpts{
+		ReturnFields: []string{"@timestamp,@logStream", "level"},
+	}}
+	want := "3 > 1 messages\n" +
+		"2020-10-12 03:00:01.000  app         error  omg first\n" +
+		"2020-10-12 03:00:02.000  app-canary         omg second\n" +
+		"(1 more)"
+	if got := p.appendMessages("3 > 1 messages", res); got != want {
+		t.Errorf("awsCWLogsInsightsPlugin.appendMessages() = %q, want %q", got, want)
+	}
+}
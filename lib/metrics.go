@@ -0,0 +1,167 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+const metricPrefix = "cwlogs_insights_check_"
+
+// checkMetrics are metrics of a check accumulated by the daemon
+type checkMetrics struct {
+	Runs int64
+	// Errors are the numbers of failed runs by the error classes
+	Errors map[string]int64
+	// Status and MatchedCount are of the latest run. HasResult is false until a run returns results.
+	Status       checkers.Status
+	MatchedCount int
+	HasResult    bool
+
+	RecordsScanned float64
+	BytesScanned   float64
+	// DurationSum is the total seconds of the runs
+	DurationSum float64
+	LastRun     time.Time
+}
+
+// daemonMetrics are metrics of the checks by their names
+type daemonMetrics map[string]*checkMetrics
+
+// record adds the result of a run of the check finished at now
+func (m daemonMetrics) record(name string, r *checkResult, elapsed time.Duration, now time.Time) {
+	cm, ok := m[name]
+	if !ok {
+		cm = &checkMetrics{Errors: map[string]int64{}}
+		m[name] = cm
+	}
+	cm.Runs++
+	cm.Status = r.Status
+	cm.DurationSum += elapsed.Seconds()
+	cm.LastRun = now
+	if r.err != nil {
+		cm.Errors[classifyError(r.err)]++
+	}
+	if r.res != nil {
+		cm.HasResult = true
+		cm.MatchedCount = r.res.MatchedCount
+		cm.RecordsScanned += r.res.Statistics.RecordsScanned
+		cm.BytesScanned += r.res.Statistics.BytesScanned
+	}
+}
+
+// snapshot returns a copy of the metrics of the checks of names
+func (m daemonMetrics) snapshot(names []string) daemonMetrics {
+	c := make(daemonMetrics, len(names))
+	for _, name := range names {
+		cm, ok := m[name]
+		if !ok {
+			continue
+		}
+		copied := *cm
+		copied.Errors = make(map[string]int64, len(cm.Errors))
+		for class, n := range cm.Errors {
+			copied.Errors[class] = n
+		}
+		c[name] = &copied
+	}
+	return c
+}
+
+// metricsWriter writes metrics in the Prometheus text format, and keeps the first error
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+func (mw *metricsWriter) family(name, typ, help string) {
+	mw.printf("# HELP %s%s %s\n# TYPE %s%s %s\n", metricPrefix, name, help, metricPrefix, name, typ)
+}
+
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	var sb strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i] + `="` + escapeLabelValue(labels[i+1]) + `"`)
+	}
+	mw.printf("%s%s{%s} %s\n", metricPrefix, name, sb.String(), strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+// write writes the metrics of the checks in the order of names
+func (m daemonMetrics) write(w io.Writer, names []string) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	get := func(name string) *checkMetrics {
+		if cm, ok := m[name]; ok {
+			return cm
+		}
+		return &checkMetrics{Errors: map[string]int64{}}
+	}
+
+	mw.family("runs_total", "counter", "Number of finished runs of the check.")
+	for _, name := range names {
+		mw.sample("runs_total", float64(get(name).Runs), "check", name)
+	}
+	mw.family("errors_total", "counter", "Number of failed runs of the check by the error class.")
+	for _, name := range names {
+		cm := get(name)
+		for _, class := range errorClasses {
+			mw.sample("errors_total", float64(cm.Errors[class]), "check", name, "class", class)
+		}
+	}
+	mw.family("status", "gauge", "Status of the latest run of the check: 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN.")
+	for _, name := range names {
+		if cm := get(name); cm.Runs > 0 {
+			mw.sample("status", float64(cm.Status), "check", name)
+		}
+	}
+	mw.family("matched_count", "gauge", "Matched log events in the window of the latest run of the check.")
+	for _, name := range names {
+		if cm := get(name); cm.HasResult {
+			mw.sample("matched_count", float64(cm.MatchedCount), "check", name)
+		}
+	}
+	mw.family("records_scanned_total", "counter", "Log events scanned by the queries of the check.")
+	for _, name := range names {
+		mw.sample("records_scanned_total", get(name).RecordsScanned, "check", name)
+	}
+	mw.family("bytes_scanned_total", "counter", "Bytes scanned by the queries of the check.")
+	for _, name := range names {
+		mw.sample("bytes_scanned_total", get(name).BytesScanned, "check", name)
+	}
+	mw.family("duration_seconds", "summary", "Time taken by the runs of the check, including the wait for the queries.")
+	for _, name := range names {
+		cm := get(name)
+		mw.sample("duration_seconds_sum", cm.DurationSum, "check", name)
+		mw.sample("duration_seconds_count", float64(cm.Runs), "check", name)
+	}
+	mw.family("last_run_timestamp_seconds", "gauge", "Unix time when the latest run of the check finished.")
+	for _, name := range names {
+		if cm := get(name); cm.Runs > 0 {
+			mw.sample("last_run_timestamp_seconds", float64(cm.LastRun.Unix()), "check", name)
+		}
+	}
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
@@ -0,0 +1,99 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+func Test_daemonMetrics_write(t *testing.T) {
+	now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	m := daemonMetrics{}
+	res := &ParsedQueryResults{Finished: true, MatchedCount: 3, Statistics: QueryStatistics{RecordsMatched: 3, RecordsScanned: 100, BytesScanned: 2048}}
+	m.record("api", &checkResult{Checker: checkers.Warning("3 > 1 messages"), res: res}, 1500*time.Millisecond, now)
+	m.record("api", &checkResult{Checker: checkers.Unknown("[timeout] query did not finish within 1m"), err: context.DeadlineExceeded}, time.Minute, now.Add(time.Minute))
+	m.record(`web "1"`, &checkResult{Checker: checkers.Ok("0 messages"), res: &ParsedQueryResults{Finished: true}}, time.Second, now)
+
+	var buf bytes.Buffer
+	if err := m.write(&buf, []string{"api", `web "1"`, "pending"}); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP cwlogs_insights_check_runs_total Number of finished runs of the check.
+# TYPE cwlogs_insights_check_runs_total counter
+cwlogs_insights_check_runs_total{check="api"} 2
+cwlogs_insights_check_runs_total{check="web \"1\""} 1
+cwlogs_insights_check_runs_total{check="pending"} 0
+# HELP cwlogs_insights_check_errors_total Number of failed runs of the check by the error class.
+# TYPE cwlogs_insights_check_errors_total counter
+cwlogs_insights_check_errors_total{check="api",class="auth"} 0
+cwlogs_insights_check_errors_total{check="api",class="throttle"} 0
+cwlogs_insights_check_errors_total{check="api",class="query"} 0
+cwlogs_insights_check_errors_total{check="api",class="timeout"} 1
+cwlogs_insights_check_errors_total{check="api",class="state"} 0
+cwlogs_insights_check_errors_total{check="api",class="invalid"} 0
+cwlogs_insights_check_errors_total{check="api",class="other"} 0
+cwlogs_insights_check_errors_total{check="web \"1\"",class="auth"} 0
+cwlogs_insights_check_errors_total{check="web \"1\"",class="throttle"} 0
+cwlogs_insights_check_errors_total{check="web \"1\"",class="query"} 0
+cwlogs_insights_check_errors_total{check="web \"1\"",class="timeout"} 0
+cwlogs_insights_check_errors_total{check="web \"1\"",class="state"} 0
+cwlogs_insights_check_errors_total{check="web \"1\"",class="invalid"} 0
+cwlogs_insights_check_errors_total{check="web \"1\"",class="other"} 0
+cwlogs_insights_check_errors_total{check="pending",class="auth"} 0
+cwlogs_insights_check_errors_total{check="pending",class="throttle"} 0
+cwlogs_insights_check_errors_total{check="pending",class="query"} 0
+cwlogs_insights_check_errors_total{check="pending",class="timeout"} 0
+cwlogs_insights_check_errors_total{check="pending",class="state"} 0
+cwlogs_insights_check_errors_total{check="pending",class="invalid"} 0
+cwlogs_insights_check_errors_total{check="pending",class="other"} 0
+# HELP cwlogs_insights_check_status Status of the latest run of the check: 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN.
+# TYPE cwlogs_insights_check_status gauge
+cwlogs_insights_check_status{check="api"} 3
+cwlogs_insights_check_status{check="web \"1\""} 0
+# HELP cwlogs_insights_check_matched_count Matched log events in the window of the latest run of the check.
+# TYPE cwlogs_insights_check_matched_count gauge
+cwlogs_insights_check_matched_count{check="api"} 3
+cwlogs_insights_check_matched_count{check="web \"1\""} 0
+# HELP cwlogs_insights_check_records_scanned_total Log events scanned by the queries of the check.
+# TYPE cwlogs_insights_check_records_scanned_total counter
+cwlogs_insights_check_records_scanned_total{check="api"} 100
+cwlogs_insights_check_records_scanned_total{check="web \"1\""} 0
+cwlogs_insights_check_records_scanned_total{check="pending"} 0
+# HELP cwlogs_insights_check_bytes_scanned_total Bytes scanned by the queries of the check.
+# TYPE cwlogs_insights_check_bytes_scanned_total counter
+cwlogs_insights_check_bytes_scanned_total{check="api"} 2048
+cwlogs_insights_check_bytes_scanned_total{check="web \"1\""} 0
+cwlogs_insights_check_bytes_scanned_total{check="pending"} 0
+# HELP cwlogs_insights_check_duration_seconds Time taken by the runs of the check, including the wait for the queries.
+# TYPE cwlogs_insights_check_duration_seconds summary
+cwlogs_insights_check_duration_seconds_sum{check="api"} 61.5
+cwlogs_insights_check_duration_seconds_count{check="api"} 2
+cwlogs_insights_check_duration_seconds_sum{check="web \"1\""} 1
+cwlogs_insights_check_duration_seconds_count{check="web \"1\""} 1
+cwlogs_insights_check_duration_seconds_sum{check="pending"} 0
+cwlogs_insights_check_duration_seconds_count{check="pending"} 0
+# HELP cwlogs_insights_check_last_run_timestamp_seconds Unix time when the latest run of the check finished.
+# TYPE cwlogs_insights_check_last_run_timestamp_seconds gauge
+cwlogs_insights_check_last_run_timestamp_seconds{check="api"} 1602471660
+cwlogs_insights_check_last_run_timestamp_seconds{check="web \"1\""} 1602471600
+`
+	if got := buf.String(); got != want {
+		t.Errorf("daemonMetrics.write() = %s, want %s", got, want)
+	}
+}
+
+func Test_daemonMetrics_snapshot(t *testing.T) {
+	now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	m := daemonMetrics{}
+	m.record("api", &checkResult{Checker: checkers.Unknown("[timeout] query did not finish within 1m"), err: context.DeadlineExceeded}, time.Minute, now)
+	m.record("web", &checkResult{Checker: checkers.Ok("0 messages"), res: &ParsedQueryResults{Finished: true}}, time.Second, now)
+
+	s := m.snapshot([]string{"api", "pending"})
+	m.record("api", &checkResult{Checker: checkers.Unknown("[timeout] query did not finish within 1m"), err: context.DeadlineExceeded}, time.Minute, now.Add(time.Minute))
+	if len(s) != 1 || s["api"].Runs != 1 || s["api"].Errors["timeout"] != 1 {
+		t.Errorf("daemonMetrics.snapshot() = %+v, changed by the later run", s)
+	}
+}
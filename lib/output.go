@@ -0,0 +1,122 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+// checkResult is the result of a check execution
+type checkResult struct {
+	*checkers.Checker
+	opts *logOpts
+	// res is nil when the query failed
+	res *ParsedQueryResults
+	// cmp is the comparison with the shifted window by --compare-offset
+	cmp *comparison
+	err error
+}
+
+// newErrorResult returns the result for err by --on-error, before the state is available
+func newErrorResult(opts *logOpts, err error) *checkResult {
+	return &checkResult{Checker: opts.errorChecker(err, nil), opts: opts, err: err}
+}
+
+// jsonReport is the document printed by --output json
+type jsonReport struct {
+	Status        string              `json:"status"`
+	Message       string              `json:"message"`
+	MatchedCount  *int                `json:"matched_count"`
+	WarningOver   int                 `json:"warning_over"`
+	CriticalOver  int                 `json:"critical_over"`
+	LogGroupNames []string            `json:"log_group_names"`
+	Window        *jsonWindow         `json:"window,omitempty"`
+	QueryID       string              `json:"query_id,omitempty"`
+	Partial       bool                `json:"partial"`
+	Statistics    *jsonStatistics     `json:"statistics,omitempty"`
+	Rows          []map[string]string `json:"rows"`
+	Comparison    *jsonComparison     `json:"comparison,omitempty"`
+	Error         string              `json:"error,omitempty"`
+	ErrorClass    string              `json:"error_class,omitempty"`
+}
+
+type jsonWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type jsonComparison struct {
+	Offset           string   `json:"offset"`
+	PastMatchedCount *int     `json:"past_matched_count"`
+	Ratio            *float64 `json:"ratio"`
+	Error            string   `json:"error,omitempty"`
+}
+
+type jsonStatistics struct {
+	RecordsMatched float64 `json:"records_matched"`
+	RecordsScanned float64 `json:"records_scanned"`
+	BytesScanned   float64 `json:"bytes_scanned"`
+}
+
+// report builds the document printed by --output json.
+// Rows are included only with --return, as the check message does.
+func (r *checkResult) report() *jsonReport {
+	rep := &jsonReport{
+		Status:        r.Status.String(),
+		Message:       r.Message,
+		WarningOver:   r.opts.WarningOver,
+		CriticalOver:  r.opts.CriticalOver,
+		LogGroupNames: r.opts.LogGroupNames,
+		Rows:          []map[string]string{},
+	}
+	if r.err != nil {
+		rep.Error = r.err.Error()
+		rep.ErrorClass = classifyError(r.err)
+	}
+	res := r.res
+	if res == nil {
+		return rep
+	}
+	rep.MatchedCount = &res.MatchedCount
+	rep.Window = &jsonWindow{Start: res.StartTime.UTC(), End: res.EndTime.UTC()}
+	rep.QueryID = res.QueryID
+	rep.Partial = res.Partial
+	rep.Statistics = &jsonStatistics{
+		RecordsMatched: res.Statistics.RecordsMatched,
+		RecordsScanned: res.Statistics.RecordsScanned,
+		BytesScanned:   res.Statistics.BytesScanned,
+	}
+	if c := r.cmp; c != nil {
+		rep.Comparison = &jsonComparison{Offset: formatOffset(c.Offset)}
+		if c.Err != nil {
+			rep.Comparison.Error = c.Err.Error()
+		} else {
+			ratio := c.ratio(res.MatchedCount)
+			rep.Comparison.PastMatchedCount = &c.PastCount
+			rep.Comparison.Ratio = &ratio
+		}
+	}
+	if r.opts.ReturnMessage {
+		for i, row := range res.Rows {
+			if i >= r.opts.returnLimit() {
+				break
+			}
+			m := make(map[string]string, len(row))
+			for _, f := range row {
+				m[f.Name] = f.Value
+			}
+			rep.Rows = append(rep.Rows, m)
+		}
+	}
+	return rep
+}
+
+// writeJSON writes the result as a JSON document to w
+func (r *checkResult) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.report())
+}
@@ -0,0 +1,129 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/checkers"
+)
+
+func Test_checkResult_writeJSON(t *testing.T) {
+	res := &ParsedQueryResults{
+		Finished:         true,
+		MatchedCount:     3,
+		ReturnedMessages: []string{"omg first", "omg second"},
+		Rows: []ResultRow{
+			{{Name: "@timestamp", Value: "2020-10-12 03:00:10.000"}, {Name: "@message", Value: "omg first"}},
+			{{Name: "@timestamp", Value: "2020-10-12 03:00:20.000"}, {Name: "@message", Value: "omg second"}},
+		},
+		Statistics: QueryStatistics{RecordsMatched: 3, RecordsScanned: 10, BytesScanned: 1024},
+		QueryID:    "DUMMY-QUERY-ID",
+		StartTime:  time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC),
+		EndTime:    time.Date(2020, 10, 12, 3, 1, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name string
+		r    *checkResult
+		want string
+	}{
+		{
+			name: "with --return",
+			r: &checkResult{
+				Checker: checkers.Critical("3 > 2 messages"),
+				opts:    &logOpts{LogGroupNames: []string{"/log/foo"}, WarningOver: 1, CriticalOver: 2, ReturnMessage: true, ReturnLimit: 1},
+				res:     res,
+			},
+			want: `{
+  "status": "CRITICAL",
+  "message": "3 > 2 messages",
+  "matched_count": 3,
+  "warning_over": 1,
+  "critical_over": 2,
+  "log_group_names": [
+    "/log/foo"
+  ],
+  "window": {
+    "start": "2020-10-12T03:00:00Z",
+    "end": "2020-10-12T03:01:00Z"
+  },
+  "query_id": "DUMMY-QUERY-ID",
+  "partial": false,
+  "statistics": {
+    "records_matched": 3,
+    "records_scanned": 10,
+    "bytes_scanned": 1024
+  },
+  "rows": [
+    {
+      "@message": "omg first",
+      "@timestamp": "2020-10-12 03:00:10.000"
+    }
+  ]
+}
+`,
+		},
+		{
+			name: "without --return",
+			r: &checkResult{
+				Checker: checkers.Critical("3 > 2 messages"),
+				opts:    &logOpts{LogGroupNames: []string{"/log/foo"}, WarningOver: 1, CriticalOver: 2},
+				res:     res,
+			},
+			want: `{
+  "status": "CRITICAL",
+  "message": "3 > 2 messages",
+  "matched_count": 3,
+  "warning_over": 1,
+  "critical_over": 2,
+  "log_group_names": [
+    "/log/foo"
+  ],
+  "window": {
+    "start": "2020-10-12T03:00:00Z",
+    "end": "2020-10-12T03:01:00Z"
+  },
+  "query_id": "DUMMY-QUERY-ID",
+  "partial": false,
+  "statistics": {
+    "records_matched": 3,
+    "records_scanned": 10,
+    "bytes_scanned": 1024
+  },
+  "rows": []
+}
+`,
+		},
+		{
+			name: "error",
+			r:    newErrorResult(&logOpts{LogGroupNames: []string{"/log/foo"}}, withClass(ErrorClassQuery, errors.New("query was finished with `Failed` status"))),
+			want: `{
+  "status": "UNKNOWN",
+  "message": "[query] query was finished with ` + "`Failed`" + ` status",
+  "matched_count": null,
+  "warning_over": 0,
+  "critical_over": 0,
+  "log_group_names": [
+    "/log/foo"
+  ],
+  "partial": false,
+  "rows": [],
+  "error": "query was finished with ` + "`Failed`" + ` status",
+  "error_class": "query"
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.r.writeJSON(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("checkResult.writeJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// clock abstracts time so that polling can be tested without sleeping
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// pollStrategy decides how long to wait between GetQueryResults calls
+type pollStrategy struct {
+	// Initial is the wait before the first poll
+	Initial time.Duration
+	// Max caps the wait between polls
+	Max time.Duration
+	// Multiplier grows the wait after each poll
+	Multiplier float64
+	// Jitter randomizes each wait by ±Jitter of it
+	Jitter float64
+	// MaxFailures is the number of failed polls in a row before giving up
+	MaxFailures int
+
+	clock clock
+	rand  func() float64
+}
+
+func defaultPollStrategy() *pollStrategy {
+	return &pollStrategy{
+		Initial:     1 * time.Second,
+		Max:         10 * time.Second,
+		Multiplier:  1.5,
+		Jitter:      0.2,
+		MaxFailures: 10,
+		clock:       realClock{},
+		rand:        rand.Float64,
+	}
+}
+
+// poller tracks the progress of polling or retrying a single operation
+type poller struct {
+	*pollStrategy
+	op       string
+	attempt  int
+	failures int
+}
+
+func (s *pollStrategy) start(op string) *poller {
+	return &poller{pollStrategy: s, op: op}
+}
+
+// delay returns the wait before the next poll
+func (p *poller) delay() time.Duration {
+	d := float64(p.Initial) * math.Pow(p.Multiplier, float64(p.attempt))
+	if d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		d *= 1 - p.Jitter + 2*p.Jitter*p.rand()
+	}
+	return time.Duration(d)
+}
+
+// wait returns a channel which receives when the next poll should be done
+func (p *poller) wait() <-chan time.Time {
+	return p.clock.After(p.delay())
+}
+
+// succeed records a successful poll
+func (p *poller) succeed() {
+	p.failures = 0
+	p.attempt++
+}
+
+// fail records a failed poll, and returns an error when it should give up.
+// Throttling errors make the following waits as long as Max at once.
+func (p *poller) fail(err error) error {
+	if giveUpErr := p.backoff(err); giveUpErr != nil {
+		return giveUpErr
+	}
+	if isThrottlingError(err) {
+		p.attempt = p.maxAttempt()
+	}
+	return nil
+}
+
+// backoff records a failed attempt, and returns an error when it should give up
+func (p *poller) backoff(err error) error {
+	p.failures++
+	if p.MaxFailures > 0 && p.failures >= p.MaxFailures {
+		return fmt.Errorf("%s failed %d times in a row: %w", p.op, p.failures, err)
+	}
+	p.attempt++
+	return nil
+}
+
+// retry waits before retrying the failed attempt.
+// It returns an error when it should give up, or the wait would exceed the deadline of ctx.
+func (p *poller) retry(ctx context.Context, err error) error {
+	d := p.delay()
+	if giveUpErr := p.backoff(err); giveUpErr != nil {
+		return giveUpErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && p.clock.Now().Add(d).After(deadline) {
+		return fmt.Errorf("%s failed and no time is left to retry: %w", p.op, err)
+	}
+	logger.Warningf("%s failed (will retry in %s): %v", p.op, d.Round(time.Millisecond), err)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.clock.After(d):
+		return nil
+	}
+}
+
+// maxAttempt returns the attempt from which delay reaches Max
+func (p *poller) maxAttempt() int {
+	if p.Multiplier <= 1 || p.Initial <= 0 || p.Max <= p.Initial {
+		return p.attempt + 1
+	}
+	return int(math.Ceil(math.Log(float64(p.Max)/float64(p.Initial)) / math.Log(p.Multiplier)))
+}
+
+// isThrottlingError reports whether err is a throttling error returned by AWS APIs.
+// It includes LimitExceededException, which StartQuery returns when too many queries are running.
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	_, ok := retry.DefaultThrottleErrorCodes[apiErr.ErrorCode()]
+	return ok
+}
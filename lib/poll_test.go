@@ -0,0 +1,111 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// fakeClock fires immediately and records requested waits
+type fakeClock struct {
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func newTestPollStrategy() *pollStrategy {
+	return &pollStrategy{
+		Initial:     time.Millisecond,
+		Max:         time.Millisecond,
+		Multiplier:  1,
+		MaxFailures: 10,
+		clock:       &fakeClock{},
+	}
+}
+
+func Test_poller(t *testing.T) {
+	throttle := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	other := errors.New("connection reset")
+	tests := []struct {
+		name      string
+		jitter    float64
+		rand      float64
+		results   []error // nil means a successful poll
+		wantWaits []time.Duration
+		wantErr   string
+	}{
+		{
+			name:      "grows exponentially up to Max",
+			results:   []error{nil, nil, nil, nil, nil},
+			wantWaits: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:      "randomized by jitter",
+			jitter:    0.5,
+			rand:      0,
+			results:   []error{nil, nil},
+			wantWaits: []time.Duration{500 * time.Millisecond, 1 * time.Second, 2 * time.Second},
+		},
+		{
+			name:      "throttling jumps to Max",
+			results:   []error{throttle, nil},
+			wantWaits: []time.Duration{1 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:      "success resets failures",
+			results:   []error{other, other, nil, other, other},
+			wantWaits: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			name:      "gives up after MaxFailures in a row",
+			results:   []error{other, throttle, other},
+			wantWaits: []time.Duration{1 * time.Second, 2 * time.Second, 10 * time.Second},
+			wantErr:   "GetQueryResults failed 3 times in a row: connection reset",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := &fakeClock{}
+			s := &pollStrategy{
+				Initial:     1 * time.Second,
+				Max:         10 * time.Second,
+				Multiplier:  2,
+				Jitter:      tt.jitter,
+				MaxFailures: 3,
+				clock:       clk,
+				rand:        func() float64 { return tt.rand },
+			}
+			p := s.start("GetQueryResults")
+			var err error
+			for _, r := range tt.results {
+				<-p.wait()
+				if r == nil {
+					p.succeed()
+				} else if err = p.fail(r); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				<-p.wait()
+			}
+			if !reflect.DeepEqual(clk.waits, tt.wantWaits) {
+				t.Errorf("waits = %v, want %v", clk.waits, tt.wantWaits)
+			}
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mackerelio/golib/logging"
+)
+
+// queryOpts is options of the query subcommand
+type queryOpts struct {
+	LogGroupNames []string `long:"log-group-name" value-name:"LOG-GROUP-NAME" description:"Log group name (Required unless --query-language=sql)" unquote:"false"`
+	QueryLanguage string   `long:"query-language" value-name:"LANGUAGE" choice:"cwli" choice:"ppl" choice:"sql" default:"cwli" description:"Query language of --filter: CloudWatch Logs Insights QL, OpenSearch PPL or OpenSearch SQL"`
+
+	Filter     string        `short:"f" long:"filter" value-name:"FILTER" description:"Filter expression to use search logs via CloudWatch Logs Insights (Required unless --filter-file)" unquote:"false"`
+	FilterFile string        `long:"filter-file" value-name:"FILE" description:"File containing the filter expression instead of --filter. It is a Go text/template rendered with --var" unquote:"false"`
+	Vars       []string      `long:"var" value-name:"KEY=VALUE" description:"Value for {{.KEY}} in --filter-file or --filter" unquote:"false"`
+	EnvVars    []string      `long:"env-var" value-name:"NAME" description:"Environment variable to expose as {{.Env.NAME}} in --filter-file or --filter" unquote:"false"`
+	Start      string        `long:"start" value-name:"TIME" description:"Start of the time range in RFC 3339 (e.g. 2020-10-12T03:00:00Z)"`
+	End        string        `long:"end" value-name:"TIME" description:"End of the time range in RFC 3339 (default: now)"`
+	Since      time.Duration `long:"since" value-name:"DURATION" description:"Search the last DURATION (e.g. 1h) instead of --start"`
+	Fields     []string      `long:"fields" value-name:"FIELDS" description:"Comma separated fields to output in addition to @message (e.g. @timestamp,@logStream)" unquote:"false"`
+	Limit      int           `long:"limit" value-name:"N" default:"100" description:"Number of rows to output (Up to 10000)"`
+	Format     string        `long:"format" value-name:"FORMAT" choice:"table" choice:"csv" choice:"json" default:"table" description:"Output format of rows"`
+	Debug      bool          `long:"debug" description:"Enable debug log"`
+
+	EndpointURL string `long:"endpoint-url" value-name:"URL" description:"Override the CloudWatch Logs endpoint URL" unquote:"false"`
+	NoVerifySSL bool   `long:"no-verify-ssl" description:"Disable verification of TLS certificates"`
+	CABundle    string `long:"ca-bundle" value-name:"FILE" description:"CA certificate bundle to use when verifying TLS certificates" unquote:"false"`
+}
+
+// logOpts returns options to run the query as the check does with --return
+func (opts *queryOpts) logOpts() *logOpts {
+	return &logOpts{
+		LogGroupNames:  opts.LogGroupNames,
+		QueryLanguage:  opts.QueryLanguage,
+		Filter:         opts.Filter,
+		FilterFile:     opts.FilterFile,
+		Vars:           opts.Vars,
+		EnvVars:        opts.EnvVars,
+		ReturnMessage:  true,
+		adHoc:          true,
+		ReturnFields:   opts.Fields,
+		ReturnLimit:    opts.Limit,
+		MinConsecutive: 1,
+		RecoverAfter:   1,
+		EndpointURL:    opts.EndpointURL,
+		NoVerifySSL:    opts.NoVerifySSL,
+		CABundle:       opts.CABundle,
+	}
+}
+
+// timeRange returns the time range to search
+func (opts *queryOpts) timeRange(now time.Time) (time.Time, time.Time, error) {
+	endTime := now
+	if opts.End != "" {
+		t, err := time.Parse(time.RFC3339, opts.End)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --end: %w", err)
+		}
+		endTime = t
+	}
+	var startTime time.Time
+	switch {
+	case opts.Start != "" && opts.Since != 0:
+		return time.Time{}, time.Time{}, errors.New("--start and --since cannot be used together")
+	case opts.Start != "":
+		t, err := time.Parse(time.RFC3339, opts.Start)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --start: %w", err)
+		}
+		startTime = t
+	case opts.Since > 0:
+		startTime = endTime.Add(-opts.Since)
+	default:
+		return time.Time{}, time.Time{}, errors.New("either --start or --since is required")
+	}
+	if !startTime.Before(endTime) {
+		return time.Time{}, time.Time{}, errors.New("start of the time range must be before the end")
+	}
+	return startTime, endTime, nil
+}
+
+// queryCommand runs the query subcommand, which runs the query of the check on the given time range
+// and prints returned rows. The state file is neither read nor written.
+func queryCommand(args []string) int {
+	opts := &queryOpts{}
+	_, err := flags.ParseArgs(opts, args)
+	if err != nil {
+		return 1
+	}
+	if opts.Debug {
+		logging.SetLogLevel(logging.DEBUG)
+	}
+	startTime, endTime, err := opts.timeRange(time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	p, err := newCWLogsInsightsPlugin(ctx, opts.logOpts(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	status := newStatusLine(os.Stderr)
+	res, err := p.query(ctx, startTime, endTime, defaultPollStrategy(), status.update)
+	status.clear()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := writeRows(os.Stdout, opts.Format, res.Rows); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d rows, %d records matched, %.0f records scanned, %.0f bytes scanned\n",
+		len(res.Rows), res.MatchedCount, res.Statistics.RecordsScanned, res.Statistics.BytesScanned)
+	return 0
+}
+
+// query runs the query on the time range and waits for it to finish, calling progress on each poll.
+// Unlike searchLogs, it doesn't touch the state file.
+func (p *awsCWLogsInsightsPlugin) query(ctx context.Context, startTime, endTime time.Time, poll *pollStrategy, progress func(*ParsedQueryResults)) (*ParsedQueryResults, error) {
+	queryID, err := p.startQueryWithRetry(ctx, startTime, endTime, poll)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start query: %w", err)
+	}
+	res, err := p.waitQuery(ctx, queryID, startTime, endTime, poll, progress)
+	if err != nil {
+		return nil, err
+	}
+	if res.FailureReason != "" {
+		return nil, withClass(ErrorClassQuery, errors.New(res.FailureReason))
+	}
+	return res, nil
+}
+
+// statusLine shows the progress of the running query on a terminal
+type statusLine struct {
+	w       io.Writer
+	enabled bool
+	started time.Time
+	width   int
+}
+
+func newStatusLine(f *os.File) *statusLine {
+	fi, err := f.Stat()
+	enabled := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	return &statusLine{w: f, enabled: enabled, started: time.Now()}
+}
+
+func (s *statusLine) update(res *ParsedQueryResults) {
+	if !s.enabled || res.Finished {
+		return
+	}
+	line := fmt.Sprintf("running %s: %d records matched, %.0f records scanned",
+		time.Since(s.started).Round(time.Second), res.MatchedCount, res.Statistics.RecordsScanned)
+	fmt.Fprintf(s.w, "\r%-*s", s.width, line)
+	s.width = len(line)
+}
+
+func (s *statusLine) clear() {
+	if !s.enabled || s.width == 0 {
+		return
+	}
+	fmt.Fprintf(s.w, "\r%s\r", strings.Repeat(" ", s.width))
+	s.width = 0
+}
+
+// columns returns field names of rows in the order they appear, except @ptr
+func columns(rows []ResultRow) []string {
+	var cols []string
+	seen := map[string]bool{"@ptr": true}
+	for _, row := range rows {
+		for _, f := range row {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				cols = append(cols, f.Name)
+			}
+		}
+	}
+	return cols
+}
+
+// writeRows writes rows to w in the format
+func writeRows(w io.Writer, format string, rows []ResultRow) error {
+	cols := columns(rows)
+	switch format {
+	case "json":
+		objs := make([]map[string]string, 0, len(rows))
+		for _, row := range rows {
+			obj := make(map[string]string, len(cols))
+			for _, col := range cols {
+				obj[col] = row.Field(col)
+			}
+			objs = append(objs, obj)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(objs)
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(cols); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			record := make([]string, len(cols))
+			for i, col := range cols {
+				record[i] = row.Field(col)
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		if len(cols) == 0 {
+			return nil
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(cols, "\t"))
+		for _, row := range rows {
+			values := make([]string, len(cols))
+			for i, col := range cols {
+				values[i] = tabReplacer.Replace(row.Field(col))
+			}
+			fmt.Fprintln(tw, strings.Join(values, "\t"))
+		}
+		return tw.Flush()
+	}
+}
@@ -0,0 +1,210 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_queryOpts_timeRange(t *testing.T) {
+	now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		opts      queryOpts
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   string
+	}{
+		{
+			name:      "since",
+			opts:      queryOpts{Since: time.Hour},
+			wantStart: now.Add(-time.Hour),
+			wantEnd:   now,
+		},
+		{
+			name:      "start and end",
+			opts:      queryOpts{Start: "2020-10-11T00:00:00Z", End: "2020-10-11T10:00:00+09:00"},
+			wantStart: time.Date(2020, 10, 11, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2020, 10, 11, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "start after end",
+			opts:    queryOpts{Start: "2020-10-11T00:00:00Z", End: "2020-10-11T01:00:00+09:00"},
+			wantErr: "start of the time range must be before the end",
+		},
+		{
+			name:      "since before end",
+			opts:      queryOpts{Since: 10 * time.Minute, End: "2020-10-11T01:00:00Z"},
+			wantStart: time.Date(2020, 10, 11, 0, 50, 0, 0, time.UTC),
+			wantEnd:   time.Date(2020, 10, 11, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "no start",
+			opts:    queryOpts{},
+			wantErr: "either --start or --since is required",
+		},
+		{
+			name:    "start and since",
+			opts:    queryOpts{Start: "2020-10-11T00:00:00Z", Since: time.Hour},
+			wantErr: "--start and --since cannot be used together",
+		},
+		{
+			name:    "invalid start",
+			opts:    queryOpts{Start: "yesterday"},
+			wantErr: `invalid --start: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := tt.opts.timeRange(now)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("queryOpts.timeRange() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("queryOpts.timeRange() error = %v", err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("queryOpts.timeRange() = [%v, %v], want [%v, %v]", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func Test_queryOpts_logOpts_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		wantErr string
+	}{
+		{
+			name:   "stats",
+			filter: "filter @message like /omg/ | stats count(*) by bin(5m)",
+		},
+		{
+			name:    "syntax error",
+			filter:  "filter @message like /omg",
+			wantErr: "invalid --filter: unterminated regular expression at offset 21",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := (&queryOpts{LogGroupNames: []string{"/log/foo"}, Filter: tt.filter}).logOpts()
+			_, err := opts.validate()
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("logOpts.validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_query_queryString(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		fields []string
+		want   string
+	}{
+		{
+			name:   "filter",
+			filter: "filter @message like /omg/",
+			want:   "filter @message like /omg/ | fields @message",
+		},
+		{
+			name:   "with fields",
+			filter: "filter @message like /omg/",
+			fields: []string{"@timestamp"},
+			want:   "filter @message like /omg/ | fields @timestamp, @message",
+		},
+		{
+			name:   "stats",
+			filter: "filter @message like /omg/ | stats count(*) by bin(5m)",
+			want:   "filter @message like /omg/ | stats count(*) by bin(5m)",
+		},
+		{
+			name:   "pattern",
+			filter: "filter @message like /omg/ | pattern @message",
+			want:   "filter @message like /omg/ | pattern @message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockAWSCloudWatchLogsClient{}
+			svc.On("StartQuery", mock.MatchedBy(func(input *cloudwatchlogs.StartQueryInput) bool {
+				return aws.ToString(input.QueryString) == tt.want
+			})).Return(&cloudwatchlogs.StartQueryOutput{QueryId: aws.String("DUMMY-QUERY-ID")}, nil).Once()
+			svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+				Status:     types.QueryStatusComplete,
+				Statistics: &types.QueryStatistics{},
+			}, nil)
+			p := &awsCWLogsInsightsPlugin{
+				Service: svc,
+				logOpts: (&queryOpts{LogGroupNames: []string{"/log/foo"}, Filter: tt.filter, Fields: tt.fields, Limit: 100}).logOpts(),
+			}
+			now := time.Date(2020, 10, 12, 3, 0, 0, 0, time.UTC)
+			if _, err := p.query(context.Background(), now.Add(-time.Hour), now, newTestPollStrategy(), nil); err != nil {
+				t.Fatal(err)
+			}
+			svc.AssertExpectations(t)
+		})
+	}
+}
+
+func Test_writeRows(t *testing.T) {
+	rows := []ResultRow{
+		{{Name: "@timestamp", Value: "2020-10-12 03:00:10.000"}, {Name: "@message", Value: "omg\tfirst"}, {Name: "@ptr", Value: "xxx"}},
+		{{Name: "@message", Value: `omg "second", again`}, {Name: "level", Value: "error"}},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: "table",
+			want: "@timestamp               @message             level\n" +
+				"2020-10-12 03:00:10.000  omg first            \n" +
+				"                         omg \"second\", again  error\n",
+		},
+		{
+			format: "csv",
+			want: "@timestamp,@message,level\n" +
+				"2020-10-12 03:00:10.000,omg\tfirst,\n" +
+				",\"omg \"\"second\"\", again\",error\n",
+		},
+		{
+			format: "json",
+			want: `[
+  {
+    "@message": "omg\tfirst",
+    "@timestamp": "2020-10-12 03:00:10.000",
+    "level": ""
+  },
+  {
+    "@message": "omg \"second\", again",
+    "@timestamp": "",
+    "level": "error"
+  }
+]
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeRows(&buf, tt.format, rows); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("writeRows() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
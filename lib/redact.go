@@ -0,0 +1,160 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// redactor replaces sensitive data in returned messages before they are output
+type redactor struct {
+	rules []redactRule
+}
+
+type redactRule struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+	// validate filters matches of re when it's not nil
+	validate func(string) bool
+}
+
+// builtinRedactRules are enabled by --redact
+var builtinRedactRules = []redactRule{
+	{
+		name:        "aws-access-key-id",
+		re:          regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[A-Z0-9]{16}\b`),
+		replacement: "[REDACTED:aws-access-key-id]",
+	},
+	{
+		name:        "aws-secret-access-key",
+		re:          regexp.MustCompile(`(?i)(secret_?access_?key["']?\s*[:=]\s*["']?)[A-Za-z0-9/+=]{40}\b`),
+		replacement: "${1}[REDACTED:aws-secret-access-key]",
+	},
+	{
+		name:        "jwt",
+		re:          regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		replacement: "[REDACTED:jwt]",
+	},
+	{
+		name:        "email",
+		re:          regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b`),
+		replacement: "[REDACTED:email]",
+	},
+	{
+		name: "credit-card",
+		// 13 to 19 digits starting with a major industry identifier of card networks
+		re:          regexp.MustCompile(`\b[3-6]\d(?:[ -]?\d){11,17}\b`),
+		replacement: "[REDACTED:credit-card]",
+		validate:    luhnValid,
+	},
+}
+
+// newRedactor returns a redactor for --redact and --redact-file.
+// It returns nil if redaction is not enabled.
+func (opts *logOpts) newRedactor() (*redactor, error) {
+	var r redactor
+	if opts.Redact {
+		r.rules = append(r.rules, builtinRedactRules...)
+	}
+	if opts.RedactFile != "" {
+		rules, err := loadRedactRules(opts.RedactFile)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rules...)
+	}
+	if len(r.rules) == 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// loadRedactRules loads rules from file.
+// Each line is a regular expression, optionally followed by " => " and its replacement.
+// Empty lines and lines starting with '#' are ignored.
+func loadRedactRules(file string) ([]redactRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open redact file: %w", err)
+	}
+	defer f.Close()
+
+	var rules []redactRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		expr, replacement, found := strings.Cut(line, " => ")
+		if !found {
+			replacement = "[REDACTED]"
+		}
+		re, err := regexp.Compile(strings.TrimSpace(expr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at %s:%d: %w", file, n, err)
+		}
+		rules = append(rules, redactRule{
+			name:        fmt.Sprintf("%s:%d", file, n),
+			re:          re,
+			replacement: strings.TrimSpace(replacement),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read redact file: %w", err)
+	}
+	return rules, nil
+}
+
+// redact returns s with sensitive data replaced
+func (r *redactor) redact(s string) string {
+	for _, rule := range r.rules {
+		if rule.validate == nil {
+			s = rule.re.ReplaceAllString(s, rule.replacement)
+			continue
+		}
+		s = rule.re.ReplaceAllStringFunc(s, func(m string) string {
+			if !rule.validate(m) {
+				return m
+			}
+			return rule.re.ReplaceAllString(m, rule.replacement)
+		})
+	}
+	return s
+}
+
+// redactResults replaces sensitive data in returned messages and rows of res
+func (r *redactor) redactResults(res *ParsedQueryResults) {
+	for i, m := range res.ReturnedMessages {
+		res.ReturnedMessages[i] = r.redact(m)
+	}
+	for _, row := range res.Rows {
+		for i := range row {
+			row[i].Value = r.redact(row[i].Value)
+		}
+	}
+}
+
+// luhnValid reports whether digits in s pass the Luhn check
+func luhnValid(s string) bool {
+	var sum, n int
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
@@ -0,0 +1,79 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var errNoQuerySlot = errors.New("all query slots are in use")
+
+// querySemaphore limits the number of concurrent queries across plugin processes
+// sharing the same directory, by locking one of the slot files in it
+type querySemaphore struct {
+	dir  string
+	size int
+}
+
+// querySlot is a slot acquired from querySemaphore
+type querySlot struct {
+	f *os.File
+}
+
+func newQuerySemaphore(stateDir string, size int) *querySemaphore {
+	return &querySemaphore{
+		dir:  filepath.Join(stateDir, "query-slots"),
+		size: size,
+	}
+}
+
+// tryAcquire acquires a free slot, or returns errNoQuerySlot when all slots are in use
+func (s *querySemaphore) tryAcquire() (*querySlot, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	for i := 0; i < s.size; i++ {
+		f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("slot-%d.lock", i)), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			return &querySlot{f: f}, nil
+		}
+		f.Close()
+	}
+	return nil, errNoQuerySlot
+}
+
+// acquire waits for a free slot with backoff
+func (s *querySemaphore) acquire(ctx context.Context, poll *pollStrategy) (*querySlot, error) {
+	retrier := poll.start("acquiring query slot")
+	for {
+		slot, err := s.tryAcquire()
+		if err == nil {
+			return slot, nil
+		}
+		if !errors.Is(err, errNoQuerySlot) {
+			return nil, err
+		}
+		if err := retrier.retry(ctx, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// release releases the slot
+func (sl *querySlot) release() error {
+	if err := unlockFile(sl.f); err != nil {
+		sl.f.Close()
+		return err
+	}
+	return sl.f.Close()
+}
@@ -0,0 +1,101 @@
+//go:build !windows
+
+package checkawscloudwatchlogsinsights
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_querySemaphore(t *testing.T) {
+	s := newQuerySemaphore(t.TempDir(), 2)
+
+	first, err := s.tryAcquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.tryAcquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.tryAcquire(); !errors.Is(err, errNoQuerySlot) {
+		t.Errorf("tryAcquire() error = %v, want errNoQuerySlot", err)
+	}
+
+	clk := &fakeClock{now: time.Now()}
+	ctx, cancel := context.WithDeadline(context.Background(), clk.now.Add(5*time.Second))
+	defer cancel()
+	poll := &pollStrategy{Initial: 1 * time.Second, Max: 1 * time.Second, Multiplier: 1, clock: clk}
+	if _, err := s.acquire(ctx, poll); !errors.Is(err, errNoQuerySlot) {
+		t.Errorf("acquire() error = %v, want errNoQuerySlot", err)
+	}
+
+	if err := first.release(); err != nil {
+		t.Fatal(err)
+	}
+	third, err := s.acquire(context.Background(), poll)
+	if err != nil {
+		t.Fatalf("acquire() error = %v, want a released slot", err)
+	}
+	for _, slot := range []*querySlot{second, third} {
+		if err := slot.release(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func Test_awsCWLogsInsightsPlugin_runQueries_holdsSlot(t *testing.T) {
+	stateDir := t.TempDir()
+	started := 0
+	svc := &mockAWSCloudWatchLogsClient{}
+	svc.On("StartQuery", mock.Anything).Return(&cloudwatchlogs.StartQueryOutput{
+		QueryId: aws.String("DUMMY-QUERY-ID"),
+	}, nil).Run(func(mock.Arguments) {
+		started++
+		if _, err := newQuerySemaphore(stateDir, 1).tryAcquire(); !errors.Is(err, errNoQuerySlot) {
+			t.Errorf("query %d started without the slot: tryAcquire() error = %v", started, err)
+		}
+	})
+	svc.On("GetQueryResults", mock.Anything).Return(&cloudwatchlogs.GetQueryResultsOutput{
+		Status:     types.QueryStatusComplete,
+		Statistics: &types.QueryStatistics{RecordsMatched: 3},
+	}, nil)
+	p := &awsCWLogsInsightsPlugin{
+		Service:   svc,
+		StateFile: filepath.Join(stateDir, "state.json"),
+		logOpts: &logOpts{
+			LogGroupNames:        []string{"/log/foo"},
+			Filter:               "filter @message like /omg/",
+			StateDir:             stateDir,
+			MaxConcurrentQueries: 1,
+			CompareOffset:        24 * time.Hour,
+			CompareWarningRatio:  2,
+		},
+	}
+	res, cmp, err := p.runQueries(context.Background(), time.Now(), newTestPollStrategy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MatchedCount != 3 || cmp == nil || cmp.Err != nil || cmp.PastCount != 3 {
+		t.Errorf("runQueries() = %+v, %+v", res, cmp)
+	}
+	if started != 2 {
+		t.Errorf("started %d queries, want 2", started)
+	}
+	// the slot is released after both of the queries
+	slot, err := newQuerySemaphore(stateDir, 1).tryAcquire()
+	if err != nil {
+		t.Fatalf("tryAcquire() error = %v, want the released slot", err)
+	}
+	if err := slot.release(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, errors.New("--max-concurrent-queries is not supported on Windows")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/natefinch/atomic"
+)
+
+// stateStore loads and saves JSON documents of the states, such as the state and the baseline,
+// by the path of their files. load returns an error satisfying os.IsNotExist when there is no document.
+type stateStore interface {
+	load(path string) ([]byte, error)
+	save(path string, data []byte) error
+}
+
+// loadJSON decodes the document of path in store into v
+func loadJSON(store stateStore, path string, v interface{}) error {
+	b, err := store.load(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON encodes v, and saves it as the document of path in store
+func saveJSON(store stateStore, path string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return store.save(path, buf.Bytes())
+}
+
+// StateStore keeps the states of checks in place of the state files, e.g. in a database.
+// key is a hash of the options, the region and the identity of the check, such as "0123456789abcdef0123456789abcdef"
+// for the state, and the same hash with ".baseline" for the baseline of --anomaly-*.
+// data is the JSON document of the state.
+// Load returns an error satisfying errors.Is(err, fs.ErrNotExist) when there is no state for key.
+type StateStore interface {
+	Load(key string) ([]byte, error)
+	Save(key string, data []byte) error
+}
+
+// publicStateStore adapts StateStore given by WithStateStore to stateStore
+type publicStateStore struct {
+	StateStore
+}
+
+// storeKey is the key in StateStore of the state file at path
+func storeKey(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".json")
+}
+
+func (s publicStateStore) load(path string) ([]byte, error) {
+	b, err := s.Load(storeKey(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		// searchLogs checks the missing state by os.IsNotExist, which doesn't unwrap err
+		return nil, &fs.PathError{Op: "load", Path: storeKey(path), Err: fs.ErrNotExist}
+	}
+	return b, err
+}
+
+func (s publicStateStore) save(path string, data []byte) error {
+	return s.Save(storeKey(path), data)
+}
+
+// fileStateStore reads and writes state files directly
+type fileStateStore struct{}
+
+func (fileStateStore) load(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (fileStateStore) save(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return atomic.WriteFile(path, bytes.NewReader(data))
+}
+
+// memoryStateStore keeps states in memory, and writes changed ones to backend by flush.
+// States not in memory yet are read from backend.
+type memoryStateStore struct {
+	backend stateStore
+
+	mu     sync.Mutex
+	states map[string][]byte
+	dirty  map[string]bool
+}
+
+func newMemoryStateStore(backend stateStore) *memoryStateStore {
+	return &memoryStateStore{
+		backend: backend,
+		states:  map[string][]byte{},
+		dirty:   map[string]bool{},
+	}
+}
+
+func (m *memoryStateStore) load(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.states[path]
+	if !ok {
+		var err error
+		b, err = m.backend.load(path)
+		if err != nil {
+			return nil, err
+		}
+		m.states[path] = b
+	}
+	return b, nil
+}
+
+func (m *memoryStateStore) save(path string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[path] = append([]byte(nil), data...)
+	m.dirty[path] = true
+	return nil
+}
+
+// flush writes changed states to backend. States failed to be written are kept to retry.
+func (m *memoryStateStore) flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var firstErr error
+	for path := range m.dirty {
+		if err := m.backend.save(path, m.states[path]); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delete(m.dirty, path)
+	}
+	return firstErr
+}
+
+// forget writes the state of path to backend if it is changed, and drops it from the memory
+func (m *memoryStateStore) forget(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirty[path] {
+		if err := m.backend.save(path, m.states[path]); err != nil {
+			return err
+		}
+		delete(m.dirty, path)
+	}
+	delete(m.states, path)
+	return nil
+}
@@ -0,0 +1,85 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_memoryStateStore(t *testing.T) {
+	dir := t.TempDir()
+	stored := filepath.Join(dir, "stored.json")
+	if err := saveJSON(fileStateStore{}, stored, &logState{EndTime: 100, LastStatus: "OK"}); err != nil {
+		t.Fatal(err)
+	}
+	m := newMemoryStateStore(fileStateStore{})
+
+	// states not in memory are read from the files
+	var s logState
+	if err := loadJSON(m, stored, &s); err != nil {
+		t.Fatal(err)
+	}
+	if want := (logState{EndTime: 100, LastStatus: "OK"}); !reflect.DeepEqual(s, want) {
+		t.Errorf("load() = %+v, want %+v", s, want)
+	}
+	if _, err := m.load(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("load() error = %v, want not exist", err)
+	}
+
+	// saved states are kept in memory until flush
+	newFile := filepath.Join(dir, "new.json")
+	saved := &logState{EndTime: 200, History: []runRecord{{EndTime: 200, Status: "WARNING", MatchedCount: 1}}}
+	if err := saveJSON(m, newFile, saved); err != nil {
+		t.Fatal(err)
+	}
+	saved.History[0].Status = "modified after save"
+	if _, err := os.Stat(newFile); !os.IsNotExist(err) {
+		t.Errorf("state file is written before flush: %v", err)
+	}
+	s = logState{}
+	if err := loadJSON(m, newFile, &s); err != nil {
+		t.Fatal(err)
+	}
+	want := logState{EndTime: 200, History: []runRecord{{EndTime: 200, Status: "WARNING", MatchedCount: 1}}}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("load() = %+v, want %+v", s, want)
+	}
+
+	if err := m.flush(); err != nil {
+		t.Fatal(err)
+	}
+	s = logState{}
+	if err := loadJSON(fileStateStore{}, newFile, &s); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("flushed state = %+v, want %+v", s, want)
+	}
+	if len(m.dirty) != 0 {
+		t.Errorf("dirty states after flush = %v", m.dirty)
+	}
+}
+
+func Test_memoryStateStore_forget(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	m := newMemoryStateStore(fileStateStore{})
+	if err := saveJSON(m, file, &logState{EndTime: 100, LastStatus: "OK"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// forget writes the changed state, and drops it
+	if err := m.forget(file); err != nil {
+		t.Fatal(err)
+	}
+	var s logState
+	if err := loadJSON(fileStateStore{}, file, &s); err != nil || s.EndTime != 100 {
+		t.Errorf("forgotten state = %+v, %v", s, err)
+	}
+	if _, ok := m.states[file]; ok {
+		t.Errorf("forgotten state is kept in memory")
+	}
+	if len(m.dirty) != 0 {
+		t.Errorf("dirty states after forget = %v", m.dirty)
+	}
+}
@@ -0,0 +1,338 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenRegex
+	tokenOperator
+	tokenPunct
+	tokenPipe
+)
+
+// token is a lexical token of the CloudWatch Logs Insights query syntax
+type token struct {
+	kind tokenKind
+	text string
+	// pos is the byte offset of the token in the query
+	pos int
+}
+
+const operatorChars = "=!<>~+-*/%^"
+
+// keywords after which a slash starts a regular expression
+var regexKeywords = map[string]bool{"like": true, "not": true, "and": true, "or": true, "in": true}
+
+// tokenizeQuery splits the query into tokens.
+// It only knows enough of the syntax to find commands and to check that literals are terminated.
+func tokenizeQuery(query string) ([]token, error) {
+	var tokens []token
+	var prev *token
+	command := ""
+	depth := 0
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := i
+		var tok token
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '|':
+			i++
+			tok = token{kind: tokenPipe, text: "|", pos: start}
+		case c == '"' || c == '\'' || c == '`':
+			end, ok := scanQuoted(query, i+1, c)
+			if !ok {
+				return nil, fmt.Errorf("unterminated string literal at offset %d", start)
+			}
+			i = end
+			tok = token{kind: tokenString, text: query[start:i], pos: start}
+		case c == '/' && regexAllowed(prev, command):
+			end, ok := scanRegex(query, i+1)
+			if !ok {
+				return nil, fmt.Errorf("unterminated regular expression at offset %d", start)
+			}
+			i = end
+			tok = token{kind: tokenRegex, text: query[start:i], pos: start}
+		case strings.IndexByte(operatorChars, c) >= 0:
+			for i < len(query) && strings.IndexByte(operatorChars, query[i]) >= 0 {
+				i++
+			}
+			tok = token{kind: tokenOperator, text: query[start:i], pos: start}
+		case strings.IndexByte("(),[]", c) >= 0:
+			i++
+			switch c {
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth < 0 {
+					return nil, fmt.Errorf("unbalanced parenthesis at offset %d", start)
+				}
+			}
+			tok = token{kind: tokenPunct, text: query[start:i], pos: start}
+		default:
+			for i < len(query) && !strings.ContainsRune(" \t\r\n#|\"'`()[],"+operatorChars, rune(query[i])) {
+				i++
+			}
+			tok = token{kind: tokenWord, text: query[start:i], pos: start}
+		}
+		if tok.kind == tokenPipe {
+			if depth > 0 {
+				return nil, fmt.Errorf("unbalanced parenthesis before offset %d", start)
+			}
+			command = ""
+		} else if command == "" && (prev == nil || prev.kind == tokenPipe) {
+			command = strings.ToLower(tok.text)
+		}
+		tokens = append(tokens, tok)
+		prev = &tokens[len(tokens)-1]
+	}
+	if depth > 0 {
+		return nil, errors.New("unbalanced parenthesis at the end of the query")
+	}
+	return tokens, nil
+}
+
+// scanQuoted returns the offset after the closing quote
+func scanQuoted(query string, i int, quote byte) (int, bool) {
+	for ; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// scanRegex returns the offset after the closing slash. A slash in a character class doesn't close it.
+func scanRegex(query string, i int) (int, bool) {
+	inClass := false
+	for ; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				return i + 1, true
+			}
+		case '\n':
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// regexAllowed reports whether a slash after prev starts a regular expression rather than a division
+func regexAllowed(prev *token, command string) bool {
+	if prev == nil {
+		return true
+	}
+	switch prev.kind {
+	case tokenOperator, tokenPipe:
+		return true
+	case tokenPunct:
+		return prev.text != ")" && prev.text != "]"
+	case tokenWord:
+		// parse takes a field and a regular expression, and doesn't do arithmetic
+		return command == "parse" || regexKeywords[strings.ToLower(prev.text)]
+	}
+	return false
+}
+
+// insightsCommand is a command of the query pipeline
+type insightsCommand struct {
+	name   string
+	tokens []token
+}
+
+// parseQuery splits the query into commands
+func parseQuery(query string) ([]insightsCommand, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty query")
+	}
+	var cmds []insightsCommand
+	var cur []token
+	for _, tok := range append(tokens, token{kind: tokenPipe, pos: len(query)}) {
+		if tok.kind != tokenPipe {
+			cur = append(cur, tok)
+			continue
+		}
+		if len(cur) == 0 {
+			return nil, fmt.Errorf("empty command before offset %d", tok.pos)
+		}
+		if cur[0].kind != tokenWord {
+			return nil, fmt.Errorf("command expected at offset %d, got %s", cur[0].pos, cur[0].text)
+		}
+		cmds = append(cmds, insightsCommand{name: strings.ToLower(cur[0].text), tokens: cur[1:]})
+		cur = nil
+	}
+	return cmds, nil
+}
+
+var knownCommands = map[string]bool{
+	"anomaly": true, "dedup": true, "diff": true, "display": true, "fields": true, "filter": true,
+	"filterindex": true, "limit": true, "lookup": true, "parse": true, "pattern": true, "sort": true,
+	"source": true, "stats": true, "unmask": true, "unnest": true,
+}
+
+// aggregateCommands replace log events by aggregated rows
+var aggregateCommands = map[string]bool{"diff": true, "pattern": true, "stats": true}
+
+// aggregates reports whether the query has a command aggregating log events
+func aggregates(query string) bool {
+	cmds, err := parseQuery(query)
+	if err != nil {
+		return false
+	}
+	for _, cmd := range cmds {
+		if aggregateCommands[cmd.name] {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFilter checks the query given by --filter before running it.
+// It returns an error for queries which can't be counted, and warnings for commands which don't work as they may look.
+func validateFilter(filter string) ([]string, error) {
+	cmds, err := parseQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	for _, cmd := range cmds {
+		switch {
+		case cmd.name == "stats":
+			return nil, errors.New("stats command is not supported, since the plugin counts matched log events")
+		case cmd.name == "limit":
+			warnings = append(warnings, "limit command doesn't limit the matched count. Use --return-limit to limit returned messages")
+		case cmd.name == "dedup":
+			warnings = append(warnings, "dedup command doesn't reduce the matched count")
+		case !knownCommands[cmd.name]:
+			warnings = append(warnings, fmt.Sprintf("unknown command %q", cmd.name))
+		}
+	}
+	return warnings, nil
+}
+
+// validate checks the options before calling AWS, and returns warnings
+func (opts *logOpts) validate() ([]string, error) {
+	if strings.TrimSpace(opts.Filter) == "" {
+		return nil, errors.New("invalid --filter: empty query")
+	}
+	if err := opts.validateLanguage(); err != nil {
+		return nil, err
+	}
+	if err := opts.validateHysteresis(); err != nil {
+		return nil, err
+	}
+	if err := opts.validateAnomaly(); err != nil {
+		return nil, err
+	}
+	if err := opts.validateComparison(); err != nil {
+		return nil, err
+	}
+	if err := opts.validateGrouping(); err != nil {
+		return nil, err
+	}
+	if _, err := parseOnError(opts.OnError); err != nil {
+		return nil, err
+	}
+	// PPL and SQL have their own syntax
+	if opts.isOpenSearchLanguage() {
+		return nil, nil
+	}
+	// commands such as stats are fine when rows are printed as they are
+	if opts.adHoc {
+		if _, err := parseQuery(opts.Filter); err != nil {
+			return nil, fmt.Errorf("invalid --filter: %w", err)
+		}
+		return nil, nil
+	}
+	warnings, err := validateFilter(opts.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --filter: %w", err)
+	}
+	return warnings, nil
+}
+
+// checkQuery validates the options, and logs warnings
+func (opts *logOpts) checkQuery() error {
+	warnings, err := opts.validate()
+	if err != nil {
+		return withClass(ErrorClassInvalid, err)
+	}
+	for _, w := range warnings {
+		logger.Warningf("--filter: %s", w)
+	}
+	return nil
+}
+
+// validateCommand runs the validate subcommand, which checks the options of the check without calling AWS,
+// and prints the query to run
+func validateCommand(args []string) int {
+	opts := &logOpts{}
+	_, err := flags.ParseArgs(opts, args)
+	if err != nil {
+		return 1
+	}
+	if err := opts.validateQuerySource(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if opts.QueryDefinition != "" {
+		fmt.Fprintln(os.Stderr, "--query-definition cannot be validated, since it is loaded from AWS")
+		return 1
+	}
+	if opts.isFilterTemplate() {
+		// the region is taken from the environment, since AWS config is not loaded
+		if err := opts.renderFilter(os.Getenv("AWS_REGION")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	warnings, err := opts.validate()
+	if err == nil {
+		_, err = opts.parseMessageTemplate()
+	}
+	if err == nil {
+		_, err = opts.newRedactor()
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	p := &awsCWLogsInsightsPlugin{logOpts: opts}
+	fmt.Println(p.fullQuery())
+	return 0
+}
@@ -0,0 +1,129 @@
+package checkawscloudwatchlogsinsights
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "single filter",
+			query:     "filter @message like /omg/",
+			wantNames: []string{"filter"},
+		},
+		{
+			name:      "pipes in literals",
+			query:     `filter @message =~ /a|b/ | filter msg = "x | y" | sort @timestamp desc`,
+			wantNames: []string{"filter", "filter", "sort"},
+		},
+		{
+			name:      "slash in character class",
+			query:     `filter @message like /path=[/a-z]+/ | fields @message`,
+			wantNames: []string{"filter", "fields"},
+		},
+		{
+			name:      "division",
+			query:     "filter (duration / 1000) > 5 | sort duration desc",
+			wantNames: []string{"filter", "sort"},
+		},
+		{
+			name:      "parse with regex",
+			query:     "parse @message /user=(?<user>\\S+)/ | filter user = 'root'",
+			wantNames: []string{"parse", "filter"},
+		},
+		{
+			name:      "comments",
+			query:     "# find errors | not a command\nfilter level = \"error\"",
+			wantNames: []string{"filter"},
+		},
+		{
+			name:    "unterminated regex",
+			query:   "filter @message like /omg",
+			wantErr: "unterminated regular expression at offset 21",
+		},
+		{
+			name:    "unterminated string",
+			query:   `filter level = "error`,
+			wantErr: "unterminated string literal at offset 15",
+		},
+		{
+			name:    "unbalanced parenthesis",
+			query:   "filter (level = 'error' | sort @timestamp",
+			wantErr: "unbalanced parenthesis before offset 24",
+		},
+		{
+			name:    "empty command",
+			query:   "filter level = 'error' |",
+			wantErr: "empty command before offset 24",
+		},
+		{
+			name:    "empty query",
+			query:   "  # nothing\n",
+			wantErr: "empty query",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds, err := parseQuery(tt.query)
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Fatalf("parseQuery() error = %v, want %q", err, tt.wantErr)
+			}
+			var names []string
+			for _, cmd := range cmds {
+				names = append(names, cmd.name)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("parseQuery() commands = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func Test_validateFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		filter       string
+		wantWarnings []string
+		wantErr      string
+	}{
+		{
+			name:   "filter and sort",
+			filter: "filter @message like /omg/ | sort @timestamp desc",
+		},
+		{
+			name:    "stats",
+			filter:  "filter @message like /omg/ | stats count(*) by bin(5m)",
+			wantErr: "stats command is not supported, since the plugin counts matched log events",
+		},
+		{
+			name:   "limit and dedup",
+			filter: "filter @message like /omg/ | dedup @logStream | limit 5",
+			wantWarnings: []string{
+				"dedup command doesn't reduce the matched count",
+				"limit command doesn't limit the matched count. Use --return-limit to limit returned messages",
+			},
+		},
+		{
+			name:         "unknown command",
+			filter:       "filtr @message like /omg/",
+			wantWarnings: []string{`unknown command "filtr"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := validateFilter(tt.filter)
+			if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Fatalf("validateFilter() error = %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+				t.Errorf("validateFilter() warnings = %v, want %v", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/mackerelio/check-aws-cloudwatch-logs-insights/internal/fakecwlogs"
+)
+
+// When this env is set, the test binary behaves as the plugin itself
+const runPluginEnv = "CHECK_AWS_CLOUDWATCH_LOGS_INSIGHTS_RUN_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runPluginEnv) != "" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runPlugin runs the plugin binary against the fake server, and returns its stdout and exit code
+func runPlugin(t *testing.T, s *fakecwlogs.Server, args ...string) (string, int) {
+	t.Helper()
+	return runBinary(t, append([]string{"--endpoint-url", s.URL}, args...)...)
+}
+
+// runBinary runs the plugin binary with args as is, and returns its stdout and exit code
+func runBinary(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(),
+		runPluginEnv+"=1",
+		"AWS_REGION=ap-northeast-1",
+		"AWS_ACCESS_KEY_ID=DUMMY-ACCESS-KEY-ID",
+		"AWS_SECRET_ACCESS_KEY=DUMMY-SECRET-ACCESS-KEY",
+		"AWS_CONFIG_FILE="+filepath.Join(t.TempDir(), "config"),
+		"AWS_SHARED_CREDENTIALS_FILE="+filepath.Join(t.TempDir(), "credentials"),
+	)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), 0
+}
+
+func TestPlugin(t *testing.T) {
+	now := time.Now()
+	stateDir := t.TempDir()
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	s.AddEvents(
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-330 * time.Second), Message: "omg first"},
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-320 * time.Second), Message: "everything is fine"},
+		fakecwlogs.Event{LogGroupName: "/log/baz", LogStreamName: "app", Timestamp: now.Add(-310 * time.Second), Message: "omg second"},
+	)
+	s.SetLifecycle(types.QueryStatusScheduled, types.QueryStatusRunning, types.QueryStatusComplete)
+	args := []string{
+		"--log-group-name", "/log/foo",
+		"--log-group-name", "/log/baz",
+		"--filter", "filter @message like /omg/",
+		"--warning-over", "1",
+		"--critical-over", "5",
+		"--state-dir", stateDir,
+		"--return",
+	}
+
+	out, code := runPlugin(t, s, args...)
+	if want := "CloudWatch Logs Insights WARNING: 2 > 1 messages\nomg second\nomg first\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+
+	// the second run continues from the end of the previous window
+	out, code = runPlugin(t, s, args...)
+	if !strings.HasPrefix(out, "CloudWatch Logs Insights OK: ") || code != 0 {
+		t.Errorf("output = %q, exit code = %d, want OK", out, code)
+	}
+	qs := s.Queries()
+	if len(qs) != 2 {
+		t.Fatalf("started %d queries, want 2", len(qs))
+	}
+	if !qs[1].StartTime.Equal(qs[0].EndTime) {
+		t.Errorf("second query starts at %v, want %v", qs[1].StartTime, qs[0].EndTime)
+	}
+	if qs[0].QueryString != "filter @message like /omg/ | fields @message" {
+		t.Errorf("QueryString = %q", qs[0].QueryString)
+	}
+}
+
+func TestPlugin_queryFailed(t *testing.T) {
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	s.SetLifecycle(types.QueryStatusRunning, types.QueryStatusFailed)
+
+	out, code := runPlugin(t, s,
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/",
+		"--state-dir", t.TempDir(),
+	)
+	if want := "CloudWatch Logs Insights UNKNOWN: [query] query was finished with `Failed` status\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+}
+
+func TestPlugin_timeout(t *testing.T) {
+	now := time.Now()
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	s.AddEvents(
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-330 * time.Second), Message: "omg first"},
+	)
+	s.SetLifecycle(types.QueryStatusRunning)
+	stateDir := t.TempDir()
+
+	out, code := runPlugin(t, s,
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/",
+		"--warning-over", "1",
+		"--critical-over", "5",
+		"--state-dir", stateDir,
+		"--timeout", "2s",
+		"--timeout-status", "warning",
+	)
+	if want := "CloudWatch Logs Insights WARNING: [timeout] query did not finish within 2s (1 messages in partial result)\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if qs := s.Queries(); len(qs) != 1 || !qs[0].Stopped {
+		t.Errorf("Queries() = %+v, want a stopped query", qs)
+	}
+	// the state is not advanced
+	if entries, _ := os.ReadDir(stateDir); len(entries) != 0 {
+		t.Errorf("state dir has %d entries, want empty", len(entries))
+	}
+}
+
+func TestPlugin_outputJSON(t *testing.T) {
+	now := time.Now()
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	s.AddEvents(
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-330 * time.Second), Message: "omg first"},
+	)
+
+	out, code := runPlugin(t, s,
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/",
+		"--critical-over", "0",
+		"--state-dir", t.TempDir(),
+		"--return",
+		"--output", "json",
+	)
+	var doc struct {
+		Status       string              `json:"status"`
+		MatchedCount int                 `json:"matched_count"`
+		QueryID      string              `json:"query_id"`
+		Rows         []map[string]string `json:"rows"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("output is not JSON: %v: %q", err, out)
+	}
+	if doc.Status != "CRITICAL" || doc.MatchedCount != 1 || doc.QueryID == "" {
+		t.Errorf("output = %+v", doc)
+	}
+	if len(doc.Rows) != 1 || doc.Rows[0]["@message"] != "omg first" {
+		t.Errorf("rows = %v", doc.Rows)
+	}
+	if code != 2 {
+		t.Errorf("exit code = %d, want 2", code)
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	s.AddEvents(
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: time.Date(2020, 10, 12, 3, 0, 10, 0, time.UTC), Message: "omg first"},
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "web", Timestamp: time.Date(2020, 10, 12, 3, 0, 20, 0, time.UTC), Message: "omg second"},
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: time.Date(2020, 10, 12, 4, 0, 0, 0, time.UTC), Message: "omg out of range"},
+	)
+
+	out, code := runBinary(t, "query",
+		"--endpoint-url", s.URL,
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/",
+		"--start", "2020-10-12T03:00:00Z",
+		"--end", "2020-10-12T03:01:00Z",
+		"--fields", "@logStream",
+		"--format", "csv",
+	)
+	if want := "@logStream,@message\nweb,omg second\napp,omg first\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	if qs := s.Queries(); len(qs) != 1 || qs[0].QueryString != "filter @message like /omg/ | fields @logStream, @message" {
+		t.Errorf("Queries() = %+v", qs)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	out, code := runBinary(t, "validate",
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/",
+		"--return",
+	)
+	if want := "filter @message like /omg/ | fields @message\n"; out != want || code != 0 {
+		t.Errorf("output = %q, exit code = %d, want %q, 0", out, code, want)
+	}
+
+	out, code = runBinary(t, "validate",
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg",
+	)
+	if out != "" || code != 1 {
+		t.Errorf("output = %q, exit code = %d, want empty, 1", out, code)
+	}
+}
+
+func TestPlugin_invalidFilter(t *testing.T) {
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+
+	out, code := runPlugin(t, s,
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/ | stats count(*)",
+		"--state-dir", t.TempDir(),
+	)
+	if want := "CloudWatch Logs Insights UNKNOWN: [invalid] invalid --filter: stats command is not supported, since the plugin counts matched log events\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if qs := s.Queries(); len(qs) != 0 {
+		t.Errorf("started %d queries, want 0", len(qs))
+	}
+}
+
+func TestPlugin_filterFile(t *testing.T) {
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	stateDir := t.TempDir()
+	file := filepath.Join(t.TempDir(), "query.txt")
+	if err := os.WriteFile(file, []byte("filter @logStream = \"{{.Env.CHECK_TEST_SERVICE}}\"\n| filter @message like /{{.word}}/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same arguments on hosts with different environments
+	for _, service := range []string{"api", "web"} {
+		t.Setenv("CHECK_TEST_SERVICE", service)
+		out, code := runPlugin(t, s,
+			"--log-group-name", "/log/foo",
+			"--filter-file", file,
+			"--var", "word=omg",
+			"--env-var", "CHECK_TEST_SERVICE",
+			"--state-dir", stateDir,
+		)
+		if !strings.HasPrefix(out, "CloudWatch Logs Insights OK: ") || code != 0 {
+			t.Errorf("output = %q, exit code = %d, want OK", out, code)
+		}
+	}
+	qs := s.Queries()
+	if len(qs) != 2 {
+		t.Fatalf("started %d queries, want 2", len(qs))
+	}
+	if want := "filter @logStream = \"web\"\n| filter @message like /omg/"; qs[1].QueryString != want {
+		t.Errorf("QueryString = %q, want %q", qs[1].QueryString, want)
+	}
+	// each rendered query has its own state
+	if entries, _ := os.ReadDir(stateDir); len(entries) != 2 {
+		t.Errorf("state dir has %d entries, want 2", len(entries))
+	}
+}
+
+func TestPlugin_compareOffset(t *testing.T) {
+	now := time.Now()
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	s.AddEvents(
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-330 * time.Second), Message: "omg first"},
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-320 * time.Second), Message: "omg second"},
+		fakecwlogs.Event{LogGroupName: "/log/foo", LogStreamName: "app", Timestamp: now.Add(-24*time.Hour - 330*time.Second), Message: "omg yesterday"},
+	)
+
+	out, code := runPlugin(t, s,
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/",
+		"--critical-over", "10",
+		"--warning-over", "10",
+		"--state-dir", t.TempDir(),
+		"--compare-offset", "24h",
+		"--compare-warning-ratio", "1.5",
+	)
+	if want := "CloudWatch Logs Insights WARNING: 2 messages (2.0x > 1.5x of 1 messages 24h ago)\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	qs := s.Queries()
+	if len(qs) != 2 {
+		t.Fatalf("started %d queries, want 2", len(qs))
+	}
+	if !qs[1].StartTime.Equal(qs[0].StartTime.Add(-24*time.Hour)) || !qs[1].EndTime.Equal(qs[0].EndTime.Add(-24*time.Hour)) {
+		t.Errorf("compared window = %v - %v, want shifted from %v - %v", qs[1].StartTime, qs[1].EndTime, qs[0].StartTime, qs[0].EndTime)
+	}
+}
+
+func TestPlugin_onError(t *testing.T) {
+	s := fakecwlogs.NewServer()
+	defer s.Close()
+	s.InjectError("StartQuery", 1, 400, "AccessDeniedException")
+
+	out, code := runPlugin(t, s,
+		"--log-group-name", "/log/foo",
+		"--filter", "filter @message like /omg/",
+		"--state-dir", t.TempDir(),
+		"--on-error", "auth=critical",
+		"--on-error", "throttle=last",
+	)
+	if !strings.HasPrefix(out, "CloudWatch Logs Insights CRITICAL: [auth] failed to start query: ") || code != 2 {
+		t.Errorf("output = %q, exit code = %d, want CRITICAL by --on-error", out, code)
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checks/api-errors" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"name": "api-errors", "updated_at": "2020-10-12T03:00:00Z", "stale": false, "status": "CRITICAL", "message": "10 > 5 messages"}`))
+	}))
+	defer srv.Close()
+
+	out, code := runBinary(t, "check", "--from-daemon", srv.URL, "--name", "api-errors")
+	if want := "CloudWatch Logs Insights CRITICAL: 10 > 5 messages\n"; out != want || code != 2 {
+		t.Errorf("output = %q, exit code = %d, want %q, 2", out, code, want)
+	}
+
+	out, code = runBinary(t, "check", "--from-daemon", srv.URL, "--name", "missing")
+	if !strings.HasPrefix(out, "CloudWatch Logs Insights UNKNOWN: failed to get the result from the daemon: 404 Not Found") || code != 3 {
+		t.Errorf("output = %q, exit code = %d, want UNKNOWN", out, code)
+	}
+}